@@ -1,18 +1,25 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strings"
 
+	"github.com/fumiama/terasu/dns"
 	"github.com/fumiama/terasu/http2"
 )
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "dns" {
+		servedns(os.Args[2:])
+		return
+	}
 	if len(os.Args) != 2 {
 		fmt.Println("Usage:", os.Args[0], "url")
+		fmt.Println("      ", os.Args[0], "dns [-l addr] [-c config] [-hosts file]")
 		return
 	}
 	if !strings.HasPrefix(os.Args[1], "https://") {
@@ -36,3 +43,36 @@ func main() {
 	}
 	fmt.Print(string(data))
 }
+
+// servedns runs a local dns server forwarding to the built-in
+// servers, or to the servers in the config file if given
+func servedns(args []string) {
+	fs := flag.NewFlagSet("dns", flag.ExitOnError)
+	addr := fs.String("l", dns.DefaultServerAddr, "listening address of udp and tcp")
+	config := fs.String("c", "", "yaml or json config of servers, watched for changes")
+	hosts := fs.String("hosts", "", "hosts file of overrides")
+	_ = fs.Parse(args)
+	if *config != "" {
+		ds := &dns.DNSList{}
+		err := ds.Watch(*config, 0)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+		dns.DefaultRouter.SetGroup("config", ds)
+		dns.DefaultRouter.SetDefault("config")
+	}
+	if *hosts != "" {
+		err := dns.HostOverrides.LoadHostsFile(*hosts)
+		if err != nil {
+			fmt.Println("ERROR:", err)
+			return
+		}
+	}
+	srv := dns.Server{Addr: *addr}
+	fmt.Println("serving dns on", *addr)
+	err := srv.ListenAndServe()
+	if err != nil {
+		fmt.Println("ERROR:", err)
+	}
+}
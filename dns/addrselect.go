@@ -0,0 +1,181 @@
+package dns
+
+import (
+	"net"
+	"net/netip"
+	"sort"
+)
+
+// policy is an entry of the default policy table of RFC 6724 2.1
+type policy struct {
+	prefix     netip.Prefix
+	precedence uint8
+	label      uint8
+}
+
+// policyTable is ordered by prefix len desc for the longest match
+var policyTable = []policy{
+	{netip.MustParsePrefix("::1/128"), 50, 0},
+	{netip.MustParsePrefix("::ffff:0:0/96"), 35, 4},
+	{netip.MustParsePrefix("::/96"), 1, 3},
+	{netip.MustParsePrefix("2001::/32"), 5, 5},
+	{netip.MustParsePrefix("2002::/16"), 30, 2},
+	{netip.MustParsePrefix("3ffe::/16"), 1, 12},
+	{netip.MustParsePrefix("fec0::/10"), 1, 11},
+	{netip.MustParsePrefix("fc00::/7"), 3, 13},
+	{netip.MustParsePrefix("::/0"), 40, 1},
+}
+
+func classify(a netip.Addr) policy {
+	// ipv4 is looked up in its mapped form
+	a = netip.AddrFrom16(a.As16())
+	for _, p := range policyTable {
+		if p.prefix.Contains(a) {
+			return p
+		}
+	}
+	return policy{}
+}
+
+const (
+	scopeLinkLocal = 0x2
+	scopeSiteLocal = 0x5
+	scopeGlobal    = 0xe
+)
+
+// scope of a by RFC 6724 3.1
+func scope(a netip.Addr) uint8 {
+	if a.IsLoopback() || a.IsLinkLocalUnicast() {
+		return scopeLinkLocal
+	}
+	b := a.As16()
+	if a.Is6() && !a.Is4In6() {
+		if a.IsMulticast() {
+			return b[1] & 0xf
+		}
+		if b[0] == 0xfe && b[1]&0xc0 == 0xc0 {
+			return scopeSiteLocal
+		}
+	}
+	return scopeGlobal
+}
+
+// sourceaddr is the source address the kernel chooses for dst,
+// which is invalid if dst is unreachable
+var sourceaddr = func(dst netip.Addr) netip.Addr {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(dst, 53)))
+	if err != nil {
+		return netip.Addr{}
+	}
+	defer conn.Close()
+	src, ok := netip.AddrFromSlice(conn.LocalAddr().(*net.UDPAddr).IP)
+	if !ok {
+		return netip.Addr{}
+	}
+	return src.Unmap()
+}
+
+type addrattr struct {
+	dst, src       netip.Addr
+	dstpol, srcpol policy
+}
+
+// sortnetip orders addrs in place by the destination address
+// selection rules of RFC 6724 6 that do not need extra knowledge
+func sortnetip(addrs []netip.Addr) {
+	if len(addrs) < 2 {
+		return
+	}
+	attrs := make([]addrattr, len(addrs))
+	for i, a := range addrs {
+		a = a.Unmap()
+		attrs[i] = addrattr{dst: a, src: sourceaddr(a), dstpol: classify(a)}
+		if attrs[i].src.IsValid() {
+			attrs[i].srcpol = classify(attrs[i].src)
+		}
+	}
+	sort.SliceStable(attrs, func(i, j int) bool {
+		return attrs[i].before(&attrs[j])
+	})
+	for i := range attrs {
+		addrs[i] = attrs[i].dst
+	}
+}
+
+// before tells whether da is preferred over db
+func (da *addrattr) before(db *addrattr) bool {
+	// rule 1: avoid unusable destinations
+	if da.src.IsValid() != db.src.IsValid() {
+		return da.src.IsValid()
+	}
+	if !da.src.IsValid() {
+		return false
+	}
+	// rule 2: prefer matching scope
+	ma, mb := scope(da.dst) == scope(da.src), scope(db.dst) == scope(db.src)
+	if ma != mb {
+		return ma
+	}
+	// rule 5: prefer matching label
+	ma, mb = da.dstpol.label == da.srcpol.label, db.dstpol.label == db.srcpol.label
+	if ma != mb {
+		return ma
+	}
+	// rule 6: prefer higher precedence
+	if da.dstpol.precedence != db.dstpol.precedence {
+		return da.dstpol.precedence > db.dstpol.precedence
+	}
+	// rule 8: prefer smaller scope
+	if sa, sb := scope(da.dst), scope(db.dst); sa != sb {
+		return sa < sb
+	}
+	// rule 9: use longest matching prefix, for ipv6 only
+	if da.dst.Is6() && db.dst.Is6() {
+		return commonprefixlen(da.src, da.dst) > commonprefixlen(db.src, db.dst)
+	}
+	// rule 10: otherwise, leave the order unchanged
+	return false
+}
+
+// commonprefixlen of a and b up to the 64 bits interface id (RFC 6724 errata 4000)
+func commonprefixlen(a, b netip.Addr) int {
+	if a.Is4() != b.Is4() {
+		return 0
+	}
+	ab, bb := a.As16(), b.As16()
+	n := 0
+	for i := 0; i < 8; i++ {
+		x := ab[i] ^ bb[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// sortaddrs orders addrs by RFC 6724, addresses
+// that cannot be parsed are kept at the end
+func sortaddrs(addrs []string) []string {
+	ips := make([]netip.Addr, 0, len(addrs))
+	var bad []string
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			bad = append(bad, a)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	sortnetip(ips)
+	sorted := make([]string, 0, len(addrs))
+	for _, ip := range ips {
+		sorted = append(sorted, ip.String())
+	}
+	return append(sorted, bad...)
+}
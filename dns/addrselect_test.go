@@ -0,0 +1,69 @@
+package dns
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestSortAddrs(t *testing.T) {
+	srcs := map[string]string{}
+	orig := sourceaddr
+	sourceaddr = func(dst netip.Addr) netip.Addr {
+		a, _ := netip.ParseAddr(srcs[dst.String()])
+		return a
+	}
+	defer func() { sourceaddr = orig }()
+
+	for _, c := range []struct {
+		srcs map[string]string
+		in   []string
+		want []string
+	}{
+		{ // ipv6 preferred by precedence
+			map[string]string{"192.0.2.1": "198.51.100.1", "2001:db8::1": "2001:db8::2"},
+			[]string{"192.0.2.1", "2001:db8::1"},
+			[]string{"2001:db8::1", "192.0.2.1"},
+		},
+		{ // unreachable ipv6 avoided
+			map[string]string{"192.0.2.1": "198.51.100.1"},
+			[]string{"2001:db8::1", "192.0.2.1", "bad"},
+			[]string{"192.0.2.1", "2001:db8::1", "bad"},
+		},
+		{ // ula source does not match global destination label
+			map[string]string{"192.0.2.1": "198.51.100.1", "2001:db8::1": "fd00::2"},
+			[]string{"2001:db8::1", "192.0.2.1"},
+			[]string{"192.0.2.1", "2001:db8::1"},
+		},
+		{ // longest matching prefix
+			map[string]string{"2001:db8:1::1": "2001:db8:1::2", "2001:db8:2::1": "2001:db8:1::2"},
+			[]string{"2001:db8:2::1", "2001:db8:1::1"},
+			[]string{"2001:db8:1::1", "2001:db8:2::1"},
+		},
+	} {
+		srcs = c.srcs
+		got := sortaddrs(c.in)
+		for i := range c.want {
+			if got[i] != c.want[i] {
+				t.Fatal("expected", c.want, "but got", got)
+			}
+		}
+	}
+}
+
+func TestLookupNetIP(t *testing.T) {
+	HostCache.Set("dual.terasu.test", []string{"2001:db8::1", "192.0.2.1", "::ffff:192.0.2.2"})
+	defer HostCache.Delete("dual.terasu.test")
+	for network, want := range map[string]int{"ip": 3, "ip4": 2, "ip6": 1} {
+		ips, err := LookupNetIP(context.Background(), network, "dual.terasu.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != want {
+			t.Fatal(network, "unexpected", ips)
+		}
+	}
+	if _, err := LookupNetIP(context.Background(), "tcp", "dual.terasu.test"); err == nil {
+		t.Fatal("expected error")
+	}
+}
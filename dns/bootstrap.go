@@ -0,0 +1,93 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrStrictBootstrap is reported when a DoH host cannot be
+	// resolved without falling back to the system resolver
+	ErrStrictBootstrap = errors.New("no bootstrap available in strict mode")
+)
+
+// bootstrapTable caches DoH hosts apart from HostCache by list and
+// strictness so that a result of the system resolver never leaks to
+// other callers or strict lists
+var bootstrapTable Cache
+
+type bootstrapkey struct{}
+
+// withbootstrap lets DoH dials of ctx resolve hosts through ds
+func withbootstrap(ctx context.Context, ds *DNSList) context.Context {
+	return context.WithValue(ctx, bootstrapkey{}, ds)
+}
+
+// bootstrapof is the list of ctx and whether it is strict
+func bootstrapof(ctx context.Context) (*DNSList, bool) {
+	ds, _ := ctx.Value(bootstrapkey{}).(*DNSList)
+	if ds == nil {
+		return nil, false
+	}
+	return ds, ds.load().strict
+}
+
+// SetStrictBootstrap forbids resolving DoH hosts of ds by the system
+// resolver. They must then have bootstrap IPs or be resolvable through
+// the plain DNS or DoT servers of ds.
+func (ds *DNSList) SetStrictBootstrap(strict bool) {
+	ds.update(func(s *serverset) {
+		s.strict = strict
+	})
+}
+
+// bootstrap resolves host of a DoH server in the order of IP literal,
+// the bootstrap IPs of up, the DoT servers of the DNSList in ctx and
+// the system resolver unless the list is strict.
+func bootstrap(ctx context.Context, host string, up *Upstream) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if up != nil && len(up.Bootstrap) > 0 {
+		return up.Bootstrap, nil
+	}
+	ds, strict := bootstrapof(ctx)
+	key := fmt.Sprintf("%p %t %s", ds, strict, host)
+	if addrs := bootstrapTable.Get(key); len(addrs) > 0 {
+		return addrs, nil
+	}
+	return lookupGroup.do(ctx, "bootstrap "+key, func(ctx context.Context) ([]string, error) {
+		var err error
+		if ds != nil {
+			resolver := net.Resolver{
+				PreferGo: true,
+				Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return ds.pipe(ctx), nil
+				},
+			}
+			var addrs []string
+			addrs, err = resolver.LookupHost(ctx, host)
+			if err == nil && len(addrs) > 0 {
+				bootstrapTable.Set(key, addrs)
+				return addrs, nil
+			}
+			logrus.Debugln("[terasu.dns] bootstrap", host, "through servers err:", err)
+		}
+		if strict {
+			if err == nil {
+				err = ErrNoDNSAvailable
+			}
+			return nil, fmt.Errorf("%w: %v", ErrStrictBootstrap, err)
+		}
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		bootstrapTable.Set(key, addrs)
+		return addrs, nil
+	})
+}
@@ -2,30 +2,103 @@ package dns
 
 import (
 	"context"
-	"time"
-
-	"github.com/FloatTech/ttl"
-	"github.com/fumiama/terasu/ip"
+	"net"
+	"net/netip"
 )
 
-var lookupTable = ttl.NewCache[string, []string](time.Hour)
-
-// LookupHost use default resolver with its fallback
+// LookupHost use HostOverrides, then default resolver with its fallback,
+// and synthesizes IPv6 addresses of IPv4-only hosts by DefaultDNS64.
+// host is normalised by ToASCII first.
 func LookupHost(ctx context.Context, host string) (addrs []string, err error) {
-	addrs = lookupTable.Get(host)
+	host, err = ToASCII(host)
+	if err != nil {
+		return
+	}
+	addrs, ok, err := HostOverrides.resolve(ctx, host, lookupCached)
+	if !ok {
+		addrs, err = lookupCached(ctx, host)
+	}
+	if err != nil {
+		return
+	}
+	return DefaultDNS64.synthesize(ctx, addrs), nil
+}
+
+// lookupCached use default resolver with its fallback
+func lookupCached(ctx context.Context, host string) (addrs []string, err error) {
+	addrs = HostCache.Get(ecsname(ctx, host))
 	if len(addrs) == 0 {
-		addrs, err = DefaultResolver.LookupHost(ctx, host)
+		addrs, err = lookupGroup.do(ctx, "ip "+ecsname(ctx, host), func(ctx context.Context) ([]string, error) {
+			return lookupHost(ctx, host)
+		})
+	}
+	return
+}
+
+// LookupNetIP looks up host like LookupHost and keeps the addresses
+// of network, which is one of "ip", "ip4" or "ip6"
+func LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	switch network {
+	case "ip", "ip4", "ip6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	addrs, err := LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]netip.Addr, 0, len(addrs))
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a)
 		if err != nil {
-			if ip.IsIPv6Available {
-				addrs, err = IPv6Servers.lookupHostDoH(ctx, host)
-			} else {
-				addrs, err = IPv4Servers.lookupHostDoH(ctx, host)
-			}
-			if err != nil {
-				return nil, err
-			}
+			continue
+		}
+		ip = ip.Unmap()
+		if (network == "ip4" && !ip.Is4()) || (network == "ip6" && !ip.Is6()) {
+			continue
 		}
-		lookupTable.Set(host, addrs)
+		ips = append(ips, ip)
 	}
+	if len(ips) == 0 {
+		return nil, ErrEmptyHostAddress
+	}
+	return ips, nil
+}
+
+// lookupHost without cache, call it through lookupGroup
+func lookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	ds, err := DefaultRouter.Pick(host)
+	if err != nil {
+		return nil, err
+	}
+	if ds.racing() {
+		addrs, err = ds.lookupHostRace(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		addrs = sortaddrs(addrs)
+		setcache(ctx, host, addrs)
+		return
+	}
+	addrs, err = DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		addrs, err = ds.lookupHostDoH(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	addrs = sortaddrs(addrs)
+	setcache(ctx, host, addrs)
 	return
 }
+
+// setcache records successfully resolved addrs in memory and on disk,
+// the answers for a client subnet stay in memory only
+func setcache(ctx context.Context, host string, addrs []string) {
+	addrs = append([]string(nil), addrs...)
+	name := ecsname(ctx, host)
+	HostCache.Set(name, addrs)
+	if name == host {
+		diskCache.put(host, addrs)
+	}
+}
@@ -0,0 +1,329 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// DefaultWatchInterval is used when Watch is called with interval 0
+const DefaultWatchInterval = time.Second * 5
+
+var (
+	// ErrUnknownConfigFormat is reported on formats other than yaml and json
+	ErrUnknownConfigFormat = errors.New("unknown config format")
+)
+
+// ConfigFormat guesses the format of a config file by its extension
+func ConfigFormat(path string) string {
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		return FormatJSON
+	}
+	return FormatYAML
+}
+
+// ParseDNSConfig decodes data in format
+func ParseDNSConfig(data []byte, format string) (*DNSConfig, error) {
+	c := &DNSConfig{}
+	var err error
+	switch format {
+	case FormatJSON:
+		err = json.Unmarshal(data, c)
+	case FormatYAML:
+		err = yaml.Unmarshal(data, c)
+	default:
+		err = ErrUnknownConfigFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range c.Stamps {
+		if err = c.AddStamp(st); err != nil {
+			return nil, err
+		}
+	}
+	c.Stamps = nil
+	return c, nil
+}
+
+// LoadDNSConfig reads a yaml or json file chosen by its extension
+func LoadDNSConfig(path string) (*DNSConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDNSConfig(data, ConfigFormat(path))
+}
+
+// Marshal encodes c in format
+func (c *DNSConfig) Marshal(format string) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.MarshalIndent(c, "", "  ")
+	case FormatYAML:
+		buf := bytes.NewBuffer(make([]byte, 0, 1024))
+		enc := yaml.NewEncoder(buf)
+		enc.SetIndent(2)
+		err := enc.Encode(c)
+		if err != nil {
+			return nil, err
+		}
+		err = enc.Close()
+		return buf.Bytes(), err
+	default:
+		return nil, ErrUnknownConfigFormat
+	}
+}
+
+// ascii is c with its stamps expanded and its internationalized hosts
+// converted by ToASCII, invalid ones are skipped
+func (c *DNSConfig) ascii() *DNSConfig {
+	convert := func(kind string, hosts map[string][]string) map[string][]string {
+		var m map[string][]string
+		for host, addrs := range hosts {
+			if isascii(host) {
+				continue
+			}
+			if m == nil {
+				m = make(map[string][]string, len(hosts))
+				for h, a := range hosts {
+					if isascii(h) {
+						// copied as other spellings may be appended
+						m[h] = append([]string(nil), a...)
+					}
+				}
+			}
+			name, err := ToASCII(host)
+			if err != nil {
+				logrus.Warnln("[terasu.dns] skip", kind, "of", host, "err:", err)
+				continue
+			}
+			m[name] = append(m[name], addrs...)
+		}
+		if m == nil {
+			return hosts
+		}
+		return m
+	}
+	n := *c
+	if len(c.Stamps) > 0 {
+		// AddStamp appends, so never touch the caller's lists
+		n.Servers = make(map[string][]string, len(c.Servers)+len(c.Stamps))
+		for host, addrs := range c.Servers {
+			n.Servers[host] = append([]string(nil), addrs...)
+		}
+		for _, st := range c.Stamps {
+			if err := n.AddStamp(st); err != nil {
+				logrus.Warnln("[terasu.dns] skip stamp", st, "err:", err)
+			}
+		}
+		n.Stamps = nil
+	}
+	n.Servers = convert("servers", n.Servers)
+	n.Fallbacks = convert("fallbacks", c.Fallbacks)
+	return &n
+}
+
+// Config exports the effective servers and fallbacks of ds
+func (ds *DNSList) Config() *DNSConfig {
+	s := ds.load()
+	c := &DNSConfig{
+		Servers:   make(map[string][]string, len(s.m)),
+		Fallbacks: make(map[string][]string, len(s.b)),
+	}
+	for _, host := range s.hostseq {
+		addrs := make([]string, 0, len(s.m[host]))
+		for _, addr := range s.m[host] {
+			addrs = append(addrs, addr.addr)
+		}
+		c.Servers[host] = addrs
+	}
+	for host, addrs := range s.b {
+		c.Fallbacks[host] = append([]string(nil), addrs...)
+	}
+	return c
+}
+
+// Replace swaps all servers and fallbacks of ds with c atomically.
+// Servers that exist both before and after keep their health state.
+func (ds *DNSList) Replace(c *DNSConfig) {
+	c = c.ascii()
+	ds.update(func(s *serverset) {
+		hostseq := make([]string, 0, len(c.Servers))
+		m := make(map[string][]*dnsstat, len(c.Servers))
+		for _, host := range s.hostseq { // keep the old order
+			if _, ok := c.Servers[host]; ok {
+				hostseq = append(hostseq, host)
+			}
+		}
+		newhosts := make([]string, 0, len(c.Servers))
+		for host := range c.Servers {
+			if _, ok := s.m[host]; !ok {
+				newhosts = append(newhosts, host)
+			}
+		}
+		sort.Strings(newhosts)
+		hostseq = append(hostseq, newhosts...)
+		for _, host := range hostseq {
+			for _, addr := range c.Servers[host] {
+				if hasrecord(m[host], addr) {
+					continue
+				}
+				stat := findrecord(s.m[host], addr)
+				if stat == nil {
+					var err error
+					stat, err = newdnsstat(addr)
+					if err != nil {
+						logrus.Warnln("[terasu.dns] skip server", host, addr, "err:", err)
+						continue
+					}
+				}
+				m[host] = append(m[host], stat)
+			}
+		}
+		b := make(map[string][]string, len(c.Fallbacks))
+		for host, addrs := range c.Fallbacks {
+			for _, addr := range addrs {
+				if !hasfallback(b[host], addr) {
+					b[host] = append(b[host], addr)
+				}
+			}
+		}
+		kept := hostseq[:0]
+		for _, host := range hostseq {
+			if len(m[host]) > 0 {
+				kept = append(kept, host)
+			}
+		}
+		s.hostseq, s.m, s.b = kept, m, b
+	})
+}
+
+// Remove the servers and fallbacks listed in c from ds.
+// A host with an empty list is removed as a whole.
+func (ds *DNSList) Remove(c *DNSConfig) {
+	c = c.ascii()
+	ds.update(func(s *serverset) {
+		for host, addrs := range c.Servers {
+			if len(addrs) > 0 {
+				kept := s.m[host][:0]
+				for _, addr := range s.m[host] {
+					if !hasfallback(addrs, addr.addr) {
+						kept = append(kept, addr)
+					}
+				}
+				s.m[host] = kept
+			}
+			if len(addrs) == 0 || len(s.m[host]) == 0 {
+				delete(s.m, host)
+			}
+		}
+		hostseq := s.hostseq[:0]
+		for _, host := range s.hostseq {
+			if _, ok := s.m[host]; ok {
+				hostseq = append(hostseq, host)
+			}
+		}
+		s.hostseq = hostseq
+		for host, addrs := range c.Fallbacks {
+			if len(addrs) > 0 {
+				kept := s.b[host][:0]
+				for _, addr := range s.b[host] {
+					if !hasfallback(addrs, addr) {
+						kept = append(kept, addr)
+					}
+				}
+				s.b[host] = kept
+			}
+			if len(addrs) == 0 || len(s.b[host]) == 0 {
+				delete(s.b, host)
+			}
+		}
+	})
+}
+
+func findrecord(lst []*dnsstat, a string) *dnsstat {
+	for _, addr := range lst {
+		if addr.addr == a {
+			return addr
+		}
+	}
+	return nil
+}
+
+// Watch replaces ds with the config at path now and then again
+// whenever the file changes, until Close.
+func (ds *DNSList) Watch(path string, interval time.Duration) error {
+	return ds.WatchReload(path, interval, nil)
+}
+
+// WatchReload is Watch that also reloads path on every receive from reload,
+// e.g. fed by the caller's own SIGHUP handler.
+func (ds *DNSList) WatchReload(path string, interval time.Duration, reload <-chan struct{}) error {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	c, err := LoadDNSConfig(path)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	ds.Replace(c)
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.watching != nil {
+		close(ds.watching)
+	}
+	ds.watching = make(chan struct{})
+	go ds.watchloop(path, interval, stat, reload, ds.watching)
+	return nil
+}
+
+func (ds *DNSList) watchloop(path string, interval time.Duration, last os.FileInfo, reload <-chan struct{}, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-reload:
+			if !ok {
+				reload = nil
+				continue
+			}
+			logrus.Infoln("[terasu.dns] reload", path, "on request")
+		case <-t.C:
+			stat, err := os.Stat(path)
+			if err != nil || (stat.ModTime().Equal(last.ModTime()) && stat.Size() == last.Size()) {
+				continue
+			}
+			logrus.Infoln("[terasu.dns] reload", path, "on change")
+		}
+		// remember what is loaded so the ticker does not load it again
+		if stat, err := os.Stat(path); err == nil {
+			last = stat
+		}
+		c, err := LoadDNSConfig(path)
+		if err != nil {
+			logrus.Warnln("[terasu.dns] reload", path, "err:", err)
+			continue
+		}
+		ds.Replace(c)
+	}
+}
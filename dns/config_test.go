@@ -0,0 +1,169 @@
+package dns
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.yaml")
+	err := os.WriteFile(path, []byte(`Servers:
+  a.test:
+    - 192.0.2.1:853
+    - 192.0.2.2:853
+  b.test:
+    - https://192.0.2.3/dns-query
+Fallbacks:
+  c.test:
+    - 192.0.2.4
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := LoadDNSConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := DNSList{}
+	ds.Replace(c)
+	s := ds.load()
+	if len(s.hostseq) != 2 || len(s.m["a.test"]) != 2 || len(s.b["c.test"]) != 1 {
+		t.Fatal("unexpected set", s.hostseq, s.m, s.b)
+	}
+	cfg := s.health.withdefaults()
+	kept := s.m["a.test"][0]
+	kept.failed(&cfg, errors.New("bad server"))
+
+	ds.Replace(&DNSConfig{Servers: map[string][]string{
+		"a.test": {"192.0.2.1:853"},
+		"d.test": {"192.0.2.5:853"},
+	}})
+	s = ds.load()
+	if len(s.hostseq) != 2 || s.hostseq[0] != "a.test" || s.hostseq[1] != "d.test" {
+		t.Fatal("unexpected hostseq", s.hostseq)
+	}
+	if s.m["a.test"][0] != kept || kept.fail.Load() != 1 {
+		t.Fatal("health state lost")
+	}
+	if len(s.b) != 0 {
+		t.Fatal("unexpected fallbacks", s.b)
+	}
+
+	ds.Remove(&DNSConfig{Servers: map[string][]string{"a.test": {"192.0.2.1:853"}, "d.test": nil}})
+	if len(ds.load().hostseq) != 0 {
+		t.Fatal("unexpected hostseq", ds.load().hostseq)
+	}
+}
+
+func TestConfigMarshal(t *testing.T) {
+	c := &DNSConfig{
+		Servers:   map[string][]string{"a.test": {"192.0.2.1:853"}},
+		Fallbacks: map[string][]string{"c.test": {"192.0.2.4"}},
+	}
+	for _, format := range []string{FormatYAML, FormatJSON} {
+		data, err := c.Marshal(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := ParseDNSConfig(data, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c2.Servers["a.test"]) != 1 || c2.Fallbacks["c.test"][0] != "192.0.2.4" {
+			t.Fatal("unexpected", format, string(data))
+		}
+	}
+}
+
+func TestConfigWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.json")
+	err := os.WriteFile(path, []byte(`{"Servers":{"a.test":["192.0.2.1:853"]}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := DNSList{}
+	defer ds.Close()
+	err = ds.Watch(path, time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.load().m["a.test"]) != 1 {
+		t.Fatal("not loaded")
+	}
+	err = os.WriteFile(path, []byte(`{"Servers":{"b.test":["192.0.2.2:853","192.0.2.3:853"]}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if len(ds.load().m["b.test"]) == 2 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("not reloaded")
+}
+
+func TestConfigWatchReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.json")
+	err := os.WriteFile(path, []byte(`{"Servers":{"a.test":["192.0.2.1:853"]}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := DNSList{}
+	defer ds.Close()
+	reload := make(chan struct{})
+	err = ds.WatchReload(path, time.Hour, reload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(`{"Servers":{"b.test":["192.0.2.2:853"]}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload <- struct{}{}
+	for i := 0; i < 100; i++ {
+		if len(ds.load().m["b.test"]) == 1 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("not reloaded")
+}
+
+func TestConfigStampsOnAdd(t *testing.T) {
+	c := &DNSConfig{
+		Servers: map[string][]string{"a.test": {"192.0.2.1:853"}},
+		Stamps:  []string{"sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5", "sdns://AA"},
+	}
+	ds := DNSList{}
+	ds.Add(c)
+	if len(ds.load().m["dns.cloudflare.com"]) != 1 || len(ds.load().m["a.test"]) != 1 {
+		t.Fatal("unexpected", ds.Config().Servers)
+	}
+	if len(c.Servers) != 1 || len(c.Stamps) != 2 {
+		t.Fatal("caller config modified", c)
+	}
+	ds.Replace(&DNSConfig{Stamps: c.Stamps})
+	if len(ds.load().m["dns.cloudflare.com"]) != 1 || len(ds.load().m) != 1 {
+		t.Fatal("unexpected", ds.Config().Servers)
+	}
+}
+
+func TestConfigMergeSpellings(t *testing.T) {
+	addrs := make([]string, 1, 4)
+	addrs[0] = "192.0.2.1:853"
+	c := &DNSConfig{Servers: map[string][]string{
+		"xn--bcher-kva.test": addrs, "bücher.test": {"192.0.2.2:853"},
+	}}
+	ds := DNSList{}
+	ds.Add(c)
+	if len(ds.load().m["xn--bcher-kva.test"]) != 2 {
+		t.Fatal("unexpected", ds.Config().Servers)
+	}
+	if addrs[:2][1] != "" || len(c.Servers["xn--bcher-kva.test"]) != 1 {
+		t.Fatal("caller config modified", addrs[:2])
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -31,65 +34,186 @@ func SetTimeout(t time.Duration) {
 }
 
 type dnsstat struct {
-	addr string
-	en   bool
-	keep bool
+	addr     string
+	up       *Upstream
+	latency  atomic.Int64 // latency is the EWMA of successful queries in ns
+	succ     atomic.Uint64
+	fail     atomic.Uint64
+	fails    atomic.Uint32 // fails is the count of consecutive failures
+	until    atomic.Int64  // until is the end of the backoff in unix ns
+	poisoned atomic.Int64  // poisoned is the end of a poison backoff, kept on later success
+	failedat atomic.Int64  // failedat is the last failure in unix ns
+	pool     streampool    // pool keeps the connections of tls and tcp servers
+	iter     iterator      // iter caches the delegations of iterative servers
 }
 
 func (ds *dnsstat) String() string {
 	sb := strings.Builder{}
 	sb.WriteString("[addr: ")
 	sb.WriteString(ds.addr)
-	sb.WriteString(", enable: ")
-	if ds.en {
-		sb.WriteString("true, keep: ")
-	} else {
-		sb.WriteString("false, keep: ")
-	}
-	if ds.keep {
-		sb.WriteString("true]")
-	} else {
-		sb.WriteString("false]")
+	sb.WriteString(", latency: ")
+	sb.WriteString(time.Duration(ds.latency.Load()).String())
+	sb.WriteString(", succ: ")
+	sb.WriteString(strconv.FormatUint(ds.succ.Load(), 10))
+	sb.WriteString(", fail: ")
+	sb.WriteString(strconv.FormatUint(ds.fail.Load(), 10))
+	if !ds.enabled() {
+		sb.WriteString(", backoff until: ")
+		sb.WriteString(ds.backoffuntil().Format(time.RFC3339))
 	}
+	sb.WriteString("]")
 	return sb.String()
 }
 
-func (ds *dnsstat) ishttps() bool {
-	return strings.HasPrefix(ds.addr, "https://")
+func newdnsstat(addr string) (*dnsstat, error) {
+	up, err := ParseUpstream(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsstat{addr: addr, up: up}, nil
 }
 
-func (ds *dnsstat) keepit() {
-	ds.keep = true
+func (ds *dnsstat) ishttps() bool {
+	return ds.up.Scheme == SchemeHTTPS
 }
 
 func (ds *dnsstat) enabled() bool {
-	return ds.keep || ds.en
+	now := time.Now().UnixNano()
+	return now >= ds.until.Load() && now >= ds.poisoned.Load()
 }
 
-func (ds *dnsstat) disable(reEnable time.Duration) {
-	if ds.keep {
-		return
+func (ds *dnsstat) backoffuntil() time.Time {
+	until := ds.until.Load()
+	if p := ds.poisoned.Load(); p > until {
+		until = p
 	}
-	ds.en = false
-	// re-enable after some times
-	time.AfterFunc(reEnable, func() {
-		ds.en = true
-	})
+	if until == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, until)
 }
 
-type DNSList struct {
-	sync.RWMutex
+// serverset is an immutable view of a DNSList, replaced as a whole on change
+type serverset struct {
 	hostseq []string
 	m       map[string][]*dnsstat
 	b       map[string][]string
+	race    int           // race the top race servers, 0 means sequential
+	stagger time.Duration // stagger between the starts of racers
+	health  HealthConfig
+	strict  bool // strict forbids bootstrapping DoH hosts by the system resolver
+	pool    PoolConfig
+	poison  PoisonConfig
+	dnssec  DNSSECConfig
+	// validator remembers the zones validated by the anchors of dnssec
+	validator *validator
+}
+
+// clone copies the containers but shares the server states
+func (s *serverset) clone() *serverset {
+	n := *s
+	n.hostseq = append(make([]string, 0, len(s.hostseq)), s.hostseq...)
+	n.m = make(map[string][]*dnsstat, len(s.m))
+	for host, addrs := range s.m {
+		n.m[host] = append(make([]*dnsstat, 0, len(addrs)), addrs...)
+	}
+	n.b = make(map[string][]string, len(s.b))
+	for host, addrs := range s.b {
+		n.b[host] = append(make([]string, 0, len(addrs)), addrs...)
+	}
+	return &n
+}
+
+// rangeHosts in sequence
+func (s *serverset) rangeHosts(fn func(host string, addrs []*dnsstat) error) error {
+	for _, h := range s.hostseq {
+		if err := fn(h, s.m[h]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DNSList is safe for concurrent use. Readers work on an atomic
+// snapshot of servers while writers replace it as a whole.
+type DNSList struct {
+	mu       sync.Mutex // mu serializes writers
+	set      atomic.Pointer[serverset]
+	probing  chan struct{} // probing is closed to stop the probe loop
+	watching chan struct{} // watching is closed to stop the config watcher
+	doh      sync.Map      // doh holds the DoH clients of the list, see dohclient
+}
+
+var emptyserverset = serverset{}
+
+func (ds *DNSList) load() *serverset {
+	if s := ds.set.Load(); s != nil {
+		return s
+	}
+	return &emptyserverset
+}
+
+// update a copy of the set by fn then publish it
+func (ds *DNSList) update(fn func(s *serverset)) {
+	ds.mu.Lock()
+	old := ds.load()
+	s := old.clone()
+	fn(s)
+	ds.set.Store(s)
+	var removed []*streampool
+	_ = old.rangeHosts(func(host string, addrs []*dnsstat) error {
+		for _, addr := range addrs {
+			if findrecord(s.m[host], addr.addr) != addr {
+				removed = append(removed, &addr.pool)
+			}
+		}
+		return nil
+	})
+	ds.mu.Unlock()
+	// close the connections of removed servers out of the lock
+	for _, p := range removed {
+		p.close()
+	}
+}
+
+// Close stops the background work of this list and closes the
+// idle connections. The list is still usable for lookups afterwards.
+func (ds *DNSList) Close() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.reset()
+	if ds.probing != nil {
+		close(ds.probing)
+		ds.probing = nil
+	}
+	if ds.watching != nil {
+		close(ds.watching)
+		ds.watching = nil
+	}
+	return nil
+}
+
+// reset closes the pooled connections only, new ones are dialed on demand
+func (ds *DNSList) reset() {
+	_ = ds.load().rangeHosts(func(_ string, addrs []*dnsstat) error {
+		for _, addr := range addrs {
+			addr.pool.reset()
+		}
+		return nil
+	})
+	ds.doh.Range(func(_, c any) bool {
+		c.(*http.Client).CloseIdleConnections()
+		return true
+	})
 }
 
 type DNSConfig struct {
-	Servers   map[string][]string `yaml:"Servers"`   // Servers map[dot.com]ip:ports
-	Fallbacks map[string][]string `yaml:"Fallbacks"` // Fallbacks map[domain]ips
+	Servers   map[string][]string `yaml:"Servers" json:"Servers"`     // Servers map[dot.com]ip:ports
+	Fallbacks map[string][]string `yaml:"Fallbacks" json:"Fallbacks"` // Fallbacks map[domain]ips
+	// Stamps are sdns:// stamps of DoH and DoT servers, merged into Servers on parse, Add and Replace
+	Stamps []string `yaml:"Stamps,omitempty" json:"Stamps,omitempty"`
 }
 
-// hasrecord no lock, use under lock
 func hasrecord(lst []*dnsstat, a string) bool {
 	for _, addr := range lst {
 		if addr.addr == a {
@@ -99,7 +223,6 @@ func hasrecord(lst []*dnsstat, a string) bool {
 	return false
 }
 
-// hasrecord no lock, use under lock
 func hasfallback(lst []string, a string) bool {
 	for _, addr := range lst {
 		if addr == a {
@@ -110,83 +233,74 @@ func hasfallback(lst []string, a string) bool {
 }
 
 func (ds *DNSList) Add(c *DNSConfig) {
-	ds.Lock()
-	defer ds.Unlock()
-	addList := map[string][]*dnsstat{}
-	addHosts := map[string]struct{}{}
-	for host, addrs := range c.Servers {
-		availableHosts, ok := ds.m[host]
-		if !ok {
-			addHosts[host] = struct{}{}
-		}
-		for _, addr := range addrs {
-			if !hasrecord(availableHosts, addr) && !hasrecord(addList[host], addr) {
-				addList[host] = append(addList[host], &dnsstat{addr, true, false})
+	c = c.ascii()
+	ds.update(func(s *serverset) {
+		for host, addrs := range c.Servers {
+			if _, ok := s.m[host]; !ok {
+				s.hostseq = append(s.hostseq, host)
 			}
-		}
-	}
-	for host, addrs := range addList {
-		ds.m[host] = append(ds.m[host], addrs...)
-	}
-	for host := range addHosts {
-		ds.hostseq = append(ds.hostseq, host)
-	}
-	addListFallback := map[string][]string{}
-	for host, addrs := range c.Fallbacks {
-		for _, addr := range addrs {
-			if !hasfallback(ds.b[host], addr) && !hasfallback(addListFallback[host], addr) {
-				addListFallback[host] = append(addListFallback[host], addr)
+			for _, addr := range addrs {
+				if hasrecord(s.m[host], addr) {
+					continue
+				}
+				stat, err := newdnsstat(addr)
+				if err != nil {
+					logrus.Warnln("[terasu.dns] skip server", host, addr, "err:", err)
+					continue
+				}
+				s.m[host] = append(s.m[host], stat)
+			}
+			if len(s.m[host]) == 0 {
+				delete(s.m, host)
+				s.hostseq = s.hostseq[:len(s.hostseq)-1]
 			}
 		}
-	}
-	for host, addrs := range addListFallback {
-		ds.b[host] = append(ds.b[host], addrs...)
-	}
-}
-
-// rangeHosts in sequence, please use in rlock
-func (ds *DNSList) rangeHosts(fn func(host string, addrs []*dnsstat) error) error {
-	for _, h := range ds.hostseq {
-		if err := fn(h, ds.m[h]); err != nil {
-			return err
+		for host, addrs := range c.Fallbacks {
+			for _, addr := range addrs {
+				if !hasfallback(s.b[host], addr) {
+					s.b[host] = append(s.b[host], addr)
+				}
+			}
 		}
-	}
-	return nil
+	})
 }
 
 func (ds *DNSList) lookupHostDoH(ctx context.Context, host string) (hosts []string, err error) {
-	ds.RLock()
-	defer ds.RUnlock()
+	ctx = withbootstrap(ctx, ds)
+	s := ds.load()
+	rs := s.ranked()
+	cfg := s.health.withdefaults()
+	fallbacks, hasfallbacks := s.b[host]
 	// try to use DoH first
-	err = ds.rangeHosts(func(_ string, addrs []*dnsstat) error {
-		for _, addr := range addrs {
-			if !addr.enabled() || !addr.ishttps() { // disabled or is not DoH
-				continue
-			}
-			jr, err := lookupdoh(ctx, addr.addr, host)
-			if err == nil {
-				hosts = jr.hosts()
-				if len(hosts) > 0 {
-					// this is a successful server, keep it
-					addr.keepit()
-					return ErrSuccess
-				}
-			}
-			if !errors.Is(err, context.Canceled) &&
-				!errors.Is(err, syscall.ENETUNREACH) &&
-				!errors.Is(err, syscall.ENETDOWN) {
-				addr.disable(time.Hour) // no need to acquire write lock
+	for _, r := range rs {
+		if !r.addr.ishttps() { // is not DoH
+			continue
+		}
+		start := time.Now()
+		jr, err := lookupdoh(ctx, r.addr.up, host)
+		if err != nil {
+			r.addr.failed(&cfg, err)
+			if errors.Is(err, context.Canceled) {
+				return nil, err
 			}
+			continue
+		}
+		hosts = jr.hosts()
+		err = s.poison.check(hosts)
+		if err != nil {
+			r.addr.failed(&cfg, err)
+			continue
+		}
+		r.addr.succeeded(&cfg, time.Since(start))
+		if len(hosts) > 0 {
+			return hosts, nil
 		}
-		return nil // not found, fallback to ds.b
-	})
-	if errors.Is(err, ErrSuccess) {
-		err = nil
 	}
-	if len(hosts) > 0 || err != nil {
-		return
+	// not found, fallback to ds.b
+	if hasfallbacks {
+		return fallbacks, nil
 	}
-	if addrs, ok := ds.b[host]; ok {
+	if addrs := diskCache.get(host); len(addrs) > 0 {
 		return addrs, nil
 	}
 	return nil, ErrNoDNSAvailable
@@ -199,157 +313,343 @@ func (ds *DNSList) DialContext(ctx context.Context, dialer *net.Dialer, firstFra
 		dialer = &dnsDialer
 	}
 
-	ds.RLock()
-	defer ds.RUnlock()
+	// the resolver's deadline is too short for a fragmented handshake
+	if dialer.Timeout != 0 || !dialer.Deadline.IsZero() {
+		ctx = context.Background()
+	}
+
+	s := ds.load()
+	rs := s.ranked()
+	cfg := s.health.withdefaults()
 
-	var conn net.Conn
-	_ = ds.rangeHosts(func(host string, addrs []*dnsstat) error {
-		for _, addr := range addrs {
-			if !addr.enabled() || addr.ishttps() { // disabled or is DoH
-				continue
+	for _, r := range rs {
+		if r.addr.up.Scheme != SchemeTLS { // is not DoT
+			continue
+		}
+		start := time.Now()
+		tlsConn, err = dialdot(ctx, dialer, r.host, r.addr, firstFragmentLen)
+		if err == nil {
+			r.addr.succeeded(&cfg, time.Since(start))
+			return
+		}
+		r.addr.failed(&cfg, err)
+	}
+	return
+}
+
+// pipe is a conn for the go resolver that sends each query
+// to the best plain DNS or DoT server
+func (ds *DNSList) pipe(ctx context.Context) net.Conn {
+	return newpipeconn(ctx, ds.exchange)
+}
+
+// exchange q with the best plain DNS or DoT server
+func (ds *DNSList) exchange(ctx context.Context, q []byte) (resp []byte, err error) {
+	err = ErrNoDNSAvailable
+
+	s := ds.load()
+	rs := s.ranked()
+	cfg := s.health.withdefaults()
+
+	for i, r := range rs {
+		if r.addr.ishttps() { // is DoH
+			continue
+		}
+		start := time.Now()
+		resp, err = r.exchange(ctx, q, s)
+		if err == nil {
+			r.addr.succeeded(&cfg, time.Since(start))
+			if s.poison.CrossCheck {
+				resp = s.crosscheck(ctx, q, resp, r, rs[i+1:])
 			}
-			logrus.Debugln("[terasu.dns] -> dial", host, addr)
-			if dialer.Timeout != 0 {
-				var cancel context.CancelFunc
-				ctx, cancel = context.WithTimeout(context.Background(), dialer.Timeout)
-				defer cancel()
-			} else if !dialer.Deadline.IsZero() {
-				var cancel context.CancelFunc
-				ctx, cancel = context.WithDeadline(context.Background(), dialer.Deadline)
-				defer cancel()
+			return
+		}
+		if ctx.Err() != nil { // given up by the caller
+			return
+		}
+		r.addr.failed(&cfg, err)
+	}
+	return
+}
+
+// crosscheck resp of r against the first server of another host in rs
+// and returns the answer to be trusted
+func (s *serverset) crosscheck(ctx context.Context, q, resp []byte, r racer, rs []racer) []byte {
+	cfg := s.health.withdefaults()
+	for _, c := range rs {
+		if c.addr.ishttps() || c.host == r.host {
+			continue
+		}
+		start := time.Now()
+		resp2, err := c.exchange(ctx, q, s)
+		if err != nil {
+			logrus.Debugln("[terasu.dns] -- cross check", c.addr, "err:", err)
+			if ctx.Err() == nil {
+				c.addr.failed(&cfg, err)
 			}
-			conn, err = dialer.DialContext(ctx, "tcp", addr.addr)
+			return resp
+		}
+		c.addr.succeeded(&cfg, time.Since(start))
+		if !disjoint(answeraddrs(resp), answeraddrs(resp2)) ||
+			r.addr.encrypted() == c.addr.encrypted() {
+			return resp
+		}
+		if c.addr.encrypted() {
+			logrus.Warnln("[terasu.dns] answer of", r.addr, "disagrees with", c.addr)
+			r.addr.failed(&cfg, ErrPoisoned)
+			return resp2
+		}
+		logrus.Warnln("[terasu.dns] answer of", c.addr, "disagrees with", r.addr)
+		c.addr.failed(&cfg, ErrPoisoned)
+		return resp
+	}
+	return resp
+}
+
+// exchange q with this plain DNS or DoT server and check the answer,
+// tls and tcp servers are pooled
+func (r *racer) exchange(ctx context.Context, q []byte, s *serverset) ([]byte, error) {
+	return s.secure(ctx, q, func(ctx context.Context, q []byte) ([]byte, error) {
+		q, err := applyecs(ctx, r.addr.up, q)
+		if err != nil {
+			return nil, err
+		}
+		q, err = applypadding(r.addr.up, q)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := r.exchangeraw(ctx, q, s)
+		if err != nil {
+			return nil, err
+		}
+		err = s.poison.checkmsg(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	})
+}
+
+func (r *racer) exchangeraw(ctx context.Context, q []byte, s *serverset) ([]byte, error) {
+	c := s.pool.withdefaults()
+	switch r.addr.up.Scheme {
+	case SchemeTLS:
+		// the dial and the handshake stop at the caller deadline or the dialer timeout
+		return r.addr.pool.exchange(ctx, &c, func(ctx context.Context) (net.Conn, error) {
+			conn, err := dialdot(ctx, &dnsDialer, r.host, r.addr, terasu.DefaultFirstFragmentLen)
 			if err != nil {
-				logrus.Debugln("[terasu.dns] -- dial tcp", host, addr, "err:", err)
-				if !errors.Is(err, context.Canceled) &&
-					!errors.Is(err, syscall.ENETUNREACH) &&
-					!errors.Is(err, syscall.ENETDOWN) {
-					addr.disable(time.Hour) // no need to acquire write lock
-				}
-				continue
-			}
-			logrus.Debugln("[terasu.dns] <- dial tcp", host, addr, "succeeded")
-			logrus.Debugln("[terasu.dns] -> hs tls", host, addr)
-			tlsConn = tls.Client(conn, &tls.Config{
-				ServerName: host,
-				MinVersion: tls.VersionTLS12,
-				NextProtos: []string{"dns"},
-			})
-			// re-init ctx due to deadline settings in tcp dial
-			if dialer.Timeout != 0 {
-				var cancel context.CancelFunc
-				ctx, cancel = context.WithTimeout(context.Background(), dialer.Timeout)
-				defer cancel()
-			} else if !dialer.Deadline.IsZero() {
-				var cancel context.CancelFunc
-				ctx, cancel = context.WithDeadline(context.Background(), dialer.Deadline)
-				defer cancel()
-			}
-			if firstFragmentLen > 0 {
-				logrus.Debugln("[terasu.dns] -- hs tls", host, addr, "use first frag len", firstFragmentLen)
-				err = terasu.Use(tlsConn).HandshakeContext(ctx, firstFragmentLen)
-			} else {
-				logrus.Debugln("[terasu.dns] -- hs tls", host, addr, "normally")
-				err = tlsConn.HandshakeContext(ctx)
-			}
-			if err == nil {
-				logrus.Debugln("[terasu.dns] <- hs tls", host, addr, "succeeded")
-				// this is a successful server, keep it
-				addr.keepit()
-				return ErrSuccess
-			}
-			logrus.Debugln("[terasu.dns] -- hs tls", host, addr, "err:", err)
-			_ = tlsConn.Close()
-			if !errors.Is(err, context.Canceled) &&
-				!errors.Is(err, syscall.ENETUNREACH) &&
-				!errors.Is(err, syscall.ENETDOWN) {
-				logrus.Debugln("[terasu.dns] == disable", host, addr)
-				addr.disable(time.Hour) // no need to acquire write lock
+				return nil, err
 			}
+			return conn, nil
+		}, q)
+	case SchemeTCP:
+		return r.addr.pool.exchange(ctx, &c, r.dialtcp, q)
+	case SchemeUDP:
+		dctx, cancel := dialctx(ctx, &dnsDialer)
+		conn, err := dnsDialer.DialContext(dctx, "udp", r.addr.up.Host)
+		cancel()
+		if err != nil {
+			return nil, err
 		}
-		return nil
-	})
-	return
+		resp, err := exchangepacket(ctx, conn, q)
+		_ = conn.Close()
+		if err == nil && truncated(resp) {
+			logrus.Debugln("[terasu.dns] -- udp", r.addr, "truncated, retry on tcp")
+			return r.addr.pool.exchange(ctx, &c, r.dialtcp, q)
+		}
+		return resp, err
+	case SchemeIterative:
+		return r.addr.iter.exchange(ctx, r.addr.up.Hints, q)
+	}
+	return nil, ErrInvalidUpstream
 }
 
-var IPv6Servers = DNSList{
-	hostseq: []string{
-		"dot.sb", "dns.google", "cloudflare-dns.com", "dns.opendns.com", "dns10.quad9.net",
-	},
-	m: map[string][]*dnsstat{
-		"dot.sb": {
-			{"[2a09::]:853", true, false},
-			{"[2a11::]:853", true, false},
-			{"https://doh.sb/dns-query", true, false},
-		},
-		"dns.google": {
-			{"[2001:4860:4860::8888]:853", true, false},
-			{"[2001:4860:4860::8844]:853", true, false},
-			{"https://dns.google/resolve", true, false},
-			{"https://[2001:4860:4860::8888]/resolve", true, false},
-			{"https://[2001:4860:4860::8844]/resolve", true, false},
-		},
-		"cloudflare-dns.com": {
-			{"[2606:4700:4700::1111]:853", true, false},
-			{"[2606:4700:4700::1001]:853", true, false},
-			{"https://cloudflare-dns.com/dns-query", true, false},
-			{"https://[2606:4700:4700::1111]/dns-query", true, false},
-			{"https://[2606:4700:4700::1001]/dns-query", true, false},
-		},
-		"dns.opendns.com": {
-			{"[2620:119:35::35]:853", true, false},
-			{"[2620:119:53::53]:853", true, false},
-		},
-		"dns10.quad9.net": {
-			{"[2620:fe::10]:853", true, false},
-			{"[2620:fe::fe:10]:853", true, false},
-		},
-	},
-	b: map[string][]string{},
+// dialtcp dials the plain tcp endpoint of this server
+func (r *racer) dialtcp(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := dialctx(ctx, &dnsDialer)
+	defer cancel()
+	return dnsDialer.DialContext(ctx, "tcp", r.addr.up.Host)
 }
 
-var IPv4Servers = DNSList{
-	hostseq: []string{
-		"dot.sb", "dns.google", "cloudflare-dns.com", "dns.opendns.com", "dns10.quad9.net",
-	},
-	m: map[string][]*dnsstat{
-		"dot.sb": {
-			{"185.222.222.222:853", true, false},
-			{"45.11.45.11:853", true, false},
-			{"https://doh.sb/dns-query", true, false},
-		},
-		"dns.google": {
-			{"8.8.8.8:853", true, false},
-			{"8.8.4.4:853", true, false},
-			{"https://dns.google/resolve", true, false},
-			{"https://8.8.8.8/resolve", true, false},
-			{"https://8.8.4.4/resolve", true, false},
+// shoulddisable tells whether err is caused by the server itself
+func shoulddisable(err error) bool {
+	return !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, syscall.ENETUNREACH) &&
+		!errors.Is(err, syscall.ENETDOWN)
+}
+
+// dialdot dials a DoT server with its own timeout derived from parent
+func dialdot(
+	parent context.Context, dialer *net.Dialer, host string, addr *dnsstat, firstFragmentLen uint8,
+) (*tls.Conn, error) {
+	logrus.Debugln("[terasu.dns] -> dial", host, addr)
+	ctx, cancel := dialctx(parent, dialer)
+	conn, err := dialer.DialContext(ctx, "tcp", addr.up.Host)
+	cancel()
+	if err != nil {
+		logrus.Debugln("[terasu.dns] -- dial tcp", host, addr, "err:", err)
+		return nil, err
+	}
+	logrus.Debugln("[terasu.dns] <- dial tcp", host, addr, "succeeded")
+	logrus.Debugln("[terasu.dns] -> hs tls", host, addr)
+	tlsConn := tls.Client(conn, addr.up.tlsconfig(&tls.Config{
+		ServerName:         host,
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         []string{"dns"},
+		ClientSessionCache: dotSessionCache,
+	}))
+	firstFragmentLen = addr.up.fragment(firstFragmentLen)
+	// re-init ctx due to deadline settings in tcp dial
+	ctx, cancel = dialctx(parent, dialer)
+	defer cancel()
+	if firstFragmentLen > 0 {
+		logrus.Debugln("[terasu.dns] -- hs tls", host, addr, "use first frag len", firstFragmentLen)
+		err = terasu.Use(tlsConn).HandshakeContext(ctx, firstFragmentLen)
+	} else {
+		logrus.Debugln("[terasu.dns] -- hs tls", host, addr, "normally")
+		err = tlsConn.HandshakeContext(ctx)
+	}
+	if err != nil {
+		logrus.Debugln("[terasu.dns] -- hs tls", host, addr, "err:", err)
+		_ = tlsConn.Close()
+		return nil, err
+	}
+	logrus.Debugln("[terasu.dns] <- hs tls", host, addr, "succeeded")
+	return tlsConn, nil
+}
+
+// dialctx applies the timeout or deadline of dialer to parent
+func dialctx(parent context.Context, dialer *net.Dialer) (context.Context, context.CancelFunc) {
+	if dialer.Timeout != 0 {
+		return context.WithTimeout(parent, dialer.Timeout)
+	}
+	if !dialer.Deadline.IsZero() {
+		return context.WithDeadline(parent, dialer.Deadline)
+	}
+	return context.WithCancel(parent)
+}
+
+var IPv6Servers, IPv4Servers DNSList
+
+func init() {
+	IPv6Servers.set.Store(newserverset(
+		[]string{
+			"dot.sb", "dns.google", "cloudflare-dns.com", "dns.opendns.com", "dns10.quad9.net",
 		},
-		"cloudflare-dns.com": {
-			{"1.1.1.1:853", true, false},
-			{"1.0.0.1:853", true, false},
-			{"https://cloudflare-dns.com/dns-query", true, false},
-			{"https://1.1.1.1/dns-query", true, false},
-			{"https://1.0.0.1/dns-query", true, false},
+		map[string][]string{
+			"dot.sb": {
+				"[2a09::]:853",
+				"[2a11::]:853",
+				"https://doh.sb/dns-query",
+			},
+			"dns.google": {
+				"[2001:4860:4860::8888]:853",
+				"[2001:4860:4860::8844]:853",
+				"https://dns.google/resolve",
+				"https://[2001:4860:4860::8888]/resolve",
+				"https://[2001:4860:4860::8844]/resolve",
+			},
+			"cloudflare-dns.com": {
+				"[2606:4700:4700::1111]:853",
+				"[2606:4700:4700::1001]:853",
+				"https://cloudflare-dns.com/dns-query",
+				"https://[2606:4700:4700::1111]/dns-query",
+				"https://[2606:4700:4700::1001]/dns-query",
+			},
+			"dns.opendns.com": {
+				"[2620:119:35::35]:853",
+				"[2620:119:53::53]:853",
+			},
+			"dns10.quad9.net": {
+				"[2620:fe::10]:853",
+				"[2620:fe::fe:10]:853",
+			},
 		},
-		"dns.opendns.com": {
-			{"208.67.222.222:853", true, false},
-			{"208.67.220.220:853", true, false},
+	))
+	IPv4Servers.set.Store(newserverset(
+		[]string{
+			"dot.sb", "dns.google", "cloudflare-dns.com", "dns.opendns.com", "dns10.quad9.net",
 		},
-		"dns10.quad9.net": {
-			{"9.9.9.10:853", true, false},
-			{"149.112.112.10:853", true, false},
+		map[string][]string{
+			"dot.sb": {
+				"185.222.222.222:853",
+				"45.11.45.11:853",
+				"https://doh.sb/dns-query",
+			},
+			"dns.google": {
+				"8.8.8.8:853",
+				"8.8.4.4:853",
+				"https://dns.google/resolve",
+				"https://8.8.8.8/resolve",
+				"https://8.8.4.4/resolve",
+			},
+			"cloudflare-dns.com": {
+				"1.1.1.1:853",
+				"1.0.0.1:853",
+				"https://cloudflare-dns.com/dns-query",
+				"https://1.1.1.1/dns-query",
+				"https://1.0.0.1/dns-query",
+			},
+			"dns.opendns.com": {
+				"208.67.222.222:853",
+				"208.67.220.220:853",
+			},
+			"dns10.quad9.net": {
+				"9.9.9.10:853",
+				"149.112.112.10:853",
+			},
 		},
-	},
-	b: map[string][]string{},
+	))
+}
+
+// newserverset from static servers, panics on invalid addresses
+func newserverset(hostseq []string, servers map[string][]string) *serverset {
+	s := &serverset{
+		hostseq: hostseq,
+		m:       make(map[string][]*dnsstat, len(servers)),
+		b:       map[string][]string{},
+	}
+	for host, addrs := range servers {
+		for _, addr := range addrs {
+			stat, err := newdnsstat(addr)
+			if err != nil {
+				panic(err)
+			}
+			s.m[host] = append(s.m[host], stat)
+		}
+	}
+	return s
 }
 
+func init() {
+	// drop what was resolved or connected for the other stack
+	ip.Subscribe(func(available bool) {
+		logrus.Infoln("[terasu.dns] ipv6 available:", available)
+		unused := &IPv6Servers
+		if available {
+			unused = &IPv4Servers
+		}
+		unused.reset()
+		HostCache.flush()
+		bootstrapTable.flush()
+	})
+}
+
+// ipv6available is ip.IPv6Available, replaced in tests
+var ipv6available = ip.IPv6Available
+
+// defaultServers chooses the list by ipv6available
+func defaultServers() *DNSList {
+	if ipv6available() {
+		return &IPv6Servers
+	}
+	return &IPv4Servers
+}
+
+// DefaultResolver sends each query to its group of DefaultRouter
 var DefaultResolver = &net.Resolver{
 	PreferGo: true,
-	Dial: func(ctx context.Context, nw, _ string) (net.Conn, error) {
-		if ip.IsIPv6Available {
-			return IPv6Servers.DialContext(ctx, nil, terasu.DefaultFirstFragmentLen)
-		}
-		return IPv4Servers.DialContext(ctx, nil, terasu.DefaultFirstFragmentLen)
+	Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return newpipeconn(ctx, DefaultRouter.exchange), nil
 	},
 }
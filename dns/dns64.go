@@ -0,0 +1,282 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/fumiama/terasu/ip"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// ipv4OnlyName is answered with AAAA only by DNS64 resolvers (RFC 7050)
+	ipv4OnlyName = "ipv4only.arpa"
+	// nat64PrefixTTL is the time a discovered prefix is trusted
+	nat64PrefixTTL = 10 * time.Minute
+	// nat64RetryTTL is the time before discovering again after a failure
+	nat64RetryTTL = time.Minute
+)
+
+var (
+	// ErrInvalidNAT64Prefix is reported on prefixes other than /32, /40, /48, /56, /64 and /96
+	ErrInvalidNAT64Prefix = errors.New("invalid nat64 prefix")
+	// ErrNoNAT64Prefix is reported when no prefix is configured or discovered
+	ErrNoNAT64Prefix = errors.New("no nat64 prefix")
+)
+
+// WellKnownNAT64Prefix is the prefix of RFC 6052 2.1
+var WellKnownNAT64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// ipv4OnlyAddrs are the A records of ipv4only.arpa
+var ipv4OnlyAddrs = [...]netip.Addr{
+	netip.AddrFrom4([4]byte{192, 0, 0, 170}),
+	netip.AddrFrom4([4]byte{192, 0, 0, 171}),
+}
+
+// discover64 asks the resolver of the network for ipv4only.arpa,
+// a DNS64 one is never among our encrypted upstreams
+var discover64 = func(ctx context.Context) ([]netip.Addr, error) {
+	return net.DefaultResolver.LookupNetIP(ctx, "ip6", ipv4OnlyName)
+}
+
+// DNS64 synthesizes IPv6 addresses of IPv4-only hosts (RFC 6147),
+// so that they are reachable by NAT64 from IPv6-only networks.
+// It only works while enabled and ip.IPv6Available.
+type DNS64 struct {
+	mu      sync.Mutex
+	enabled bool
+	prefix  netip.Prefix // prefix is the configured one
+	found   netip.Prefix // found is the discovered one
+	exp     time.Time
+}
+
+// DefaultDNS64 is used by LookupHost and Server, disabled by default
+var DefaultDNS64 DNS64
+
+// Enable synthesis by prefix, or by the prefix
+// discovered by RFC 7050 if prefix is the zero value
+func (d *DNS64) Enable(prefix netip.Prefix) error {
+	if prefix.IsValid() && !validnat64(prefix) {
+		return ErrInvalidNAT64Prefix
+	}
+	d.mu.Lock()
+	d.enabled, d.prefix = true, prefix.Masked()
+	d.found, d.exp = netip.Prefix{}, time.Time{}
+	d.mu.Unlock()
+	return nil
+}
+
+// Disable synthesis
+func (d *DNS64) Disable() {
+	d.mu.Lock()
+	d.enabled = false
+	d.mu.Unlock()
+}
+
+// forget the discovered prefix, as the network changed
+func (d *DNS64) forget() {
+	d.mu.Lock()
+	d.found, d.exp = netip.Prefix{}, time.Time{}
+	d.mu.Unlock()
+}
+
+func validnat64(p netip.Prefix) bool {
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return false
+	}
+	switch p.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+		return true
+	}
+	return false
+}
+
+// active tells whether d should synthesize now
+func (d *DNS64) active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.enabled && ipv6available()
+}
+
+// Prefix is the configured prefix, or the one discovered by RFC 7050
+func (d *DNS64) Prefix(ctx context.Context) (netip.Prefix, error) {
+	d.mu.Lock()
+	if d.prefix.IsValid() {
+		defer d.mu.Unlock()
+		return d.prefix, nil
+	}
+	if time.Now().Before(d.exp) {
+		defer d.mu.Unlock()
+		if d.found.IsValid() {
+			return d.found, nil
+		}
+		return netip.Prefix{}, ErrNoNAT64Prefix
+	}
+	d.mu.Unlock()
+	addrs, err := discover64(ctx)
+	p := netip.Prefix{}
+	if err == nil {
+		p = nat64prefix(addrs)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.found = p
+	if !p.IsValid() {
+		logrus.Debugln("[terasu.dns] no nat64 prefix of", ipv4OnlyName, "err:", err)
+		d.exp = time.Now().Add(nat64RetryTTL)
+		return p, ErrNoNAT64Prefix
+	}
+	logrus.Debugln("[terasu.dns] discovered nat64 prefix", p)
+	d.exp = time.Now().Add(nat64PrefixTTL)
+	return p, nil
+}
+
+// nat64prefix finds the prefix embedding a well-known address of ipv4only.arpa
+func nat64prefix(addrs []netip.Addr) netip.Prefix {
+	for _, a := range addrs {
+		if !a.Is6() || a.Is4In6() {
+			continue
+		}
+		for _, bits := range []int{96, 64, 56, 48, 40, 32} {
+			v4 := extract64(a, bits)
+			if v4 == ipv4OnlyAddrs[0] || v4 == ipv4OnlyAddrs[1] {
+				p, _ := a.Prefix(bits)
+				return p
+			}
+		}
+	}
+	return netip.Prefix{}
+}
+
+// embed64 places v4 after the prefix p, skipping the bits 64 to 71 (RFC 6052 2.2)
+func embed64(p netip.Prefix, v4 netip.Addr) netip.Addr {
+	b := p.Masked().Addr().As16()
+	off := p.Bits() / 8
+	for _, c := range v4.As4() {
+		if off == 8 {
+			off++
+		}
+		b[off] = c
+		off++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// extract64 is the IPv4 embedded in a by a prefix of bits
+func extract64(a netip.Addr, bits int) netip.Addr {
+	b := a.As16()
+	var v4 [4]byte
+	off := bits / 8
+	for i := range v4 {
+		if off == 8 {
+			off++
+		}
+		v4[i] = b[off]
+		off++
+	}
+	return netip.AddrFrom4(v4)
+}
+
+// synthesizable tells whether v4 may be embedded into p, the well-known
+// prefix must not carry non-global addresses (RFC 6052 3.1)
+func synthesizable(p netip.Prefix, v4 netip.Addr) bool {
+	if v4.IsLoopback() || v4.IsUnspecified() || v4.IsLinkLocalUnicast() || v4.IsMulticast() {
+		return false
+	}
+	return p != WellKnownNAT64Prefix || !v4.IsPrivate()
+}
+
+// synthesize prepends the IPv6 addresses of the IPv4 ones in addrs
+// if d is active and addrs has no IPv6
+func (d *DNS64) synthesize(ctx context.Context, addrs []string) []string {
+	if !d.active() {
+		return addrs
+	}
+	var v4s []netip.Addr
+	for _, a := range addrs {
+		ip, err := netip.ParseAddr(a)
+		if err != nil {
+			continue
+		}
+		if ip.Is6() && !ip.Is4In6() {
+			return addrs
+		}
+		v4s = append(v4s, ip.Unmap())
+	}
+	if len(v4s) == 0 {
+		return addrs
+	}
+	p, err := d.Prefix(ctx)
+	if err != nil {
+		return addrs
+	}
+	synthesized := make([]string, 0, len(addrs)*2)
+	for _, v4 := range v4s {
+		if synthesizable(p, v4) {
+			synthesized = append(synthesized, embed64(p, v4).String())
+		}
+	}
+	return append(synthesized, addrs...)
+}
+
+// synthesizemsg answers an AAAA query of qi from the A records by ds
+// if resp has no AAAA, nil means not synthesized
+func (d *DNS64) synthesizemsg(ctx context.Context, qi *queryinfo, ds *DNSList, resp []byte) []byte {
+	if qi.question.Type != dnsmessage.TypeAAAA || qi.question.Class != dnsmessage.ClassINET || !d.active() {
+		return nil
+	}
+	var m dnsmessage.Message
+	if m.Unpack(resp) != nil || m.RCode != dnsmessage.RCodeSuccess {
+		return nil
+	}
+	for _, r := range m.Answers {
+		if r.Header.Type == dnsmessage.TypeAAAA {
+			return nil
+		}
+	}
+	p, err := d.Prefix(ctx)
+	if err != nil {
+		return nil
+	}
+	q, err := newquery(qi.header.ID, normname(qi.question.Name.String()), dnsmessage.TypeA)
+	if err != nil {
+		return nil
+	}
+	aresp, err := ds.exchangeall(ctx, q)
+	if err != nil {
+		return nil
+	}
+	var am dnsmessage.Message
+	if am.Unpack(aresp) != nil || am.RCode != dnsmessage.RCodeSuccess {
+		return nil
+	}
+	answers := make([]dnsmessage.Resource, 0, len(am.Answers))
+	for _, r := range am.Answers {
+		a, ok := r.Body.(*dnsmessage.AResource)
+		if !ok {
+			answers = append(answers, r) // keep the cname chain
+			continue
+		}
+		v4 := netip.AddrFrom4(a.A)
+		if !synthesizable(p, v4) {
+			continue
+		}
+		h := r.Header
+		h.Type = dnsmessage.TypeAAAA
+		answers = append(answers, dnsmessage.Resource{
+			Header: h, Body: &dnsmessage.AAAAResource{AAAA: embed64(p, v4).As16()},
+		})
+	}
+	return qi.reply(dnsmessage.RCodeSuccess, answers)
+}
+
+func init() {
+	ip.Subscribe(func(bool) {
+		DefaultDNS64.forget()
+	})
+}
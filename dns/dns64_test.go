@@ -0,0 +1,110 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNAT64Embed(t *testing.T) {
+	// RFC 6052 2.4
+	v4 := netip.MustParseAddr("192.0.2.33")
+	for p, want := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+	} {
+		prefix := netip.MustParsePrefix(p)
+		a := embed64(prefix, v4)
+		if a.String() != want {
+			t.Fatal(p, "unexpected", a)
+		}
+		if extract64(a, prefix.Bits()) != v4 {
+			t.Fatal(p, "unexpected extraction", extract64(a, prefix.Bits()))
+		}
+	}
+	d := DNS64{}
+	if err := d.Enable(netip.MustParsePrefix("2001:db8::/36")); err != ErrInvalidNAT64Prefix {
+		t.Fatal("unexpected", err)
+	}
+}
+
+func TestDNS64Discovery(t *testing.T) {
+	defer func(f func(context.Context) ([]netip.Addr, error)) { discover64 = f }(discover64)
+	defer func(f func() bool) { ipv6available = f }(ipv6available)
+	ipv6available = func() bool { return true }
+
+	var answer []netip.Addr
+	queries := 0
+	discover64 = func(context.Context) ([]netip.Addr, error) {
+		queries++
+		if answer == nil {
+			return nil, errors.New("no such host")
+		}
+		return answer, nil
+	}
+	d := DNS64{}
+	addrs := []string{"192.0.2.1"}
+	if got := d.synthesize(context.Background(), addrs); len(got) != 1 {
+		t.Fatal("synthesized while disabled", got)
+	}
+	if err := d.Enable(netip.Prefix{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.synthesize(context.Background(), addrs); len(got) != 1 {
+		t.Fatal("synthesized without prefix", got)
+	}
+	// the failure is remembered
+	d.synthesize(context.Background(), addrs)
+	if queries != 1 {
+		t.Fatal("unexpected discovery count", queries)
+	}
+
+	answer = []netip.Addr{netip.MustParseAddr("2001:db8:122:344:c0:0:aa00:0")}
+	d.forget()
+	got := d.synthesize(context.Background(), []string{"192.0.2.1", "10.0.0.1", "127.0.0.1"})
+	if len(got) != 5 || got[0] != "2001:db8:122:344:c0:2:100:0" || got[1] != "2001:db8:122:344:a:0:100:0" {
+		t.Fatal("unexpected", got)
+	}
+	if got = d.synthesize(context.Background(), []string{"192.0.2.1", "2001:db8::1"}); len(got) != 2 {
+		t.Fatal("synthesized with aaaa", got)
+	}
+
+	// no private address in the well-known prefix
+	if err := d.Enable(WellKnownNAT64Prefix); err != nil {
+		t.Fatal(err)
+	}
+	got = d.synthesize(context.Background(), []string{"192.0.2.1", "10.0.0.1"})
+	if len(got) != 3 || got[0] != "64:ff9b::c000:201" {
+		t.Fatal("unexpected", got)
+	}
+	ipv6available = func() bool { return false }
+	if got = d.synthesize(context.Background(), addrs); len(got) != 1 {
+		t.Fatal("synthesized without ipv6", got)
+	}
+}
+
+func TestServerDNS64(t *testing.T) {
+	defer func(f func() bool) { ipv6available = f }(ipv6available)
+	ipv6available = func() bool { return true }
+	d := &DNS64{}
+	if err := d.Enable(WellKnownNAT64Prefix); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := startserver(t, &Server{DNS64: d})
+	m := askudp(t, addr, rawquery(t, "v4only.terasu.test.", dnsmessage.TypeAAAA))
+	if m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) != 1 {
+		t.Fatal("unexpected", m)
+	}
+	aaaa, ok := m.Answers[0].Body.(*dnsmessage.AAAAResource)
+	if !ok || netip.AddrFrom16(aaaa.AAAA).String() != "64:ff9b::c000:201" {
+		t.Fatal("unexpected", m.Answers[0])
+	}
+}
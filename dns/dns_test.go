@@ -13,7 +13,7 @@ import (
 )
 
 func TestResolver(t *testing.T) {
-	t.Log("IsIPv6Available:", ip.IsIPv6Available)
+	t.Log("IsIPv6Available:", ip.IPv6Available())
 	addrs, err := DefaultResolver.LookupHost(context.TODO(), "huggingface.co")
 	if err != nil {
 		t.Fatal(err)
@@ -25,9 +25,9 @@ func TestResolver(t *testing.T) {
 }
 
 func TestResolverFallback(t *testing.T) {
-	t.Log("IsIPv6Available:", ip.IsIPv6Available)
+	t.Log("IsIPv6Available:", ip.IPv6Available())
 
-	if ip.IsIPv6Available {
+	if ip.IPv6Available() {
 		addrs, err := IPv6Servers.lookupHostDoH(context.TODO(), "huggingface.co")
 		if err != nil {
 			t.Fatal(err)
@@ -48,7 +48,7 @@ func TestResolverFallback(t *testing.T) {
 }
 
 func TestDNS(t *testing.T) {
-	if ip.IsIPv6Available {
+	if ip.IPv6Available() {
 		IPv6Servers.test()
 	}
 	IPv4Servers.test()
@@ -66,27 +66,19 @@ func TestDNS(t *testing.T) {
 }
 
 func TestBadDNS(t *testing.T) {
-	dotv6serversseqbak := IPv6Servers.hostseq
-	dotv4serversseqbak := IPv4Servers.hostseq
-	dotv6serversbak := IPv6Servers.m
-	dotv4serversbak := IPv4Servers.m
+	dotv6serversbak := IPv6Servers.set.Load()
+	dotv4serversbak := IPv4Servers.set.Load()
 	defer func() {
-		IPv6Servers.hostseq = dotv6serversseqbak
-		IPv4Servers.hostseq = dotv4serversseqbak
-		IPv6Servers.m = dotv6serversbak
-		IPv4Servers.m = dotv4serversbak
+		IPv6Servers.set.Store(dotv6serversbak)
+		IPv4Servers.set.Store(dotv4serversbak)
 	}()
-	if ip.IsIPv6Available {
-		IPv6Servers = DNSList{
-			m: map[string][]*dnsstat{},
-		}
+	if ip.IPv6Available() {
+		IPv6Servers.set.Store(&serverset{})
 		IPv6Servers.Add(&DNSConfig{
 			Servers: map[string][]string{"test.bad.host": {"169.254.122.111"}},
 		})
 	} else {
-		IPv4Servers = DNSList{
-			m: map[string][]*dnsstat{},
-		}
+		IPv4Servers.set.Store(&serverset{})
 		IPv4Servers.Add(&DNSConfig{
 			Servers: map[string][]string{"test.bad.host": {"169.254.122.111:853"}},
 		})
@@ -102,9 +94,7 @@ func TestBadDNS(t *testing.T) {
 }
 
 func (ds *DNSList) test() {
-	ds.RLock()
-	defer ds.RUnlock()
-	_ = ds.rangeHosts(func(host string, addrs []*dnsstat) error {
+	_ = ds.load().rangeHosts(func(host string, addrs []*dnsstat) error {
 		for _, addr := range addrs {
 			if !addr.enabled() {
 				continue
@@ -129,3 +119,18 @@ func (ds *DNSList) test() {
 		return nil
 	})
 }
+
+func TestResolverRace(t *testing.T) {
+	t.Log("IsIPv6Available:", ip.IPv6Available())
+	ds := defaultServers()
+	ds.SetRace(4, 0)
+	defer ds.SetRace(0, 0)
+	addrs, err := ds.lookupHostRace(context.TODO(), "huggingface.co")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(addrs)
+	if len(addrs) == 0 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,629 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxZoneTTL caps the time a validated zone is remembered
+	maxZoneTTL = time.Hour
+	// bogusZoneTTL is the time a failed zone is remembered
+	bogusZoneTTL = time.Minute
+)
+
+var (
+	// ErrBogus is reported in strict mode on answers failing DNSSEC validation
+	ErrBogus = errors.New("dnssec bogus answer")
+	// ErrInvalidAnchor is reported on malformed trust anchors
+	ErrInvalidAnchor = errors.New("invalid trust anchor")
+)
+
+// RootAnchors are the DS of the root KSKs, KSK-2017 and KSK-2024
+var RootAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Security is the DNSSEC status of an answer (RFC 4035 4.3)
+type Security uint8
+
+const (
+	// Indeterminate is not validated or unable to validate
+	Indeterminate Security = iota
+	// Insecure is proven to be in an unsigned zone
+	Insecure
+	// Secure has a valid chain of signatures from the trust anchor
+	Secure
+	// Bogus should be signed but the signatures are missing or invalid
+	Bogus
+)
+
+// worse of s and o, bogus > indeterminate > insecure > secure
+func (s Security) worse(o Security) Security {
+	rank := [...]int{Secure: 0, Insecure: 1, Indeterminate: 2, Bogus: 3}
+	if rank[o] > rank[s] {
+		return o
+	}
+	return s
+}
+
+func (s Security) String() string {
+	switch s {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "indeterminate"
+}
+
+// DNSSECConfig tells how to validate answers
+type DNSSECConfig struct {
+	// Validate requests and checks the signatures of answers from plain DNS,
+	// DoT and wire DoH servers, and sets the AD bit of the secure ones.
+	// Queries with the CD bit set are passed through.
+	Validate bool
+	// Strict rejects bogus answers and tries the next server
+	Strict bool
+	// Anchors are DS records of the root like "20326 8 2 E06D...",
+	// RootAnchors if empty
+	Anchors []string
+}
+
+// SetDNSSEC replaces the DNSSEC config of ds
+func (ds *DNSList) SetDNSSEC(c DNSSECConfig) error {
+	v, err := newvalidator(c.Anchors)
+	if err != nil {
+		return err
+	}
+	ds.update(func(s *serverset) {
+		s.dnssec = c
+		s.validator = v
+	})
+	return nil
+}
+
+// zone is the state of the zone enclosing a name
+type zone struct {
+	apex string
+	sec  Security
+	keys []*dnskey // keys are the validated zone keys of a secure zone
+	exp  time.Time
+}
+
+// validator keeps the zones validated from its anchors
+type validator struct {
+	anchors []*dsrecord
+	now     func() time.Time
+	zones   Cache // zones holds *zone by names, a zone may be shared by many names
+}
+
+func newvalidator(anchors []string) (*validator, error) {
+	if len(anchors) == 0 {
+		anchors = RootAnchors
+	}
+	v := &validator{now: time.Now}
+	for _, a := range anchors {
+		f := strings.Fields(a)
+		if len(f) != 4 {
+			return nil, ErrInvalidAnchor
+		}
+		tag, err1 := strconv.ParseUint(f[0], 10, 16)
+		alg, err2 := strconv.ParseUint(f[1], 10, 8)
+		dt, err3 := strconv.ParseUint(f[2], 10, 8)
+		digest, err4 := hex.DecodeString(f[3])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			return nil, ErrInvalidAnchor
+		}
+		v.anchors = append(v.anchors, &dsrecord{keytag: uint16(tag), alg: uint8(alg), digesttype: uint8(dt), digest: digest})
+	}
+	return v, nil
+}
+
+var (
+	defaultValidatorOnce sync.Once
+	defaultValidator     *validator
+)
+
+// validatorof s, or the one of RootAnchors
+func (s *serverset) validatorof() *validator {
+	if s.validator != nil {
+		return s.validator
+	}
+	defaultValidatorOnce.Do(func() {
+		defaultValidator, _ = newvalidator(nil)
+	})
+	return defaultValidator
+}
+
+// dnssecquery packs a query with the DO and CD bits, so that
+// the upstream returns the signatures and leaves checking to us
+func dnssecquery(name string, typ uint16) ([]byte, error) {
+	q, err := newquery(0, strings.TrimSuffix(name, "."), dnsmessage.Type(typ))
+	if err != nil {
+		return nil, err
+	}
+	q[3] |= 0x10        // CD bit
+	q[len(q)-4] |= 0x80 // the DO bit of the empty OPT at the end
+	return q, nil
+}
+
+// query name in typ by ex and group the answer
+func (v *validator) query(ctx context.Context, ex exchanger, name string, typ uint16) (*dnssecmsg, error) {
+	q, err := dnssecquery(name, typ)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ex(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	dm, err := parsednssec(resp)
+	if err != nil {
+		return nil, err
+	}
+	if dm.rcode != dnsmessage.RCodeSuccess && dm.rcode != dnsmessage.RCodeNameError {
+		return nil, errors.New("rcode: " + dm.rcode.String())
+	}
+	return dm, nil
+}
+
+// zoneof name walks down from the root to find the enclosing zone
+func (v *validator) zoneof(ctx context.Context, ex exchanger, name string) (*zone, error) {
+	z, ok := v.zones.load(name).(*zone)
+	if ok && v.now().Before(z.exp) {
+		return z, nil
+	}
+	if name == "." {
+		z = v.rootzone(ctx, ex)
+	} else {
+		parent, err := v.zoneof(ctx, ex, parentname(name))
+		if err != nil {
+			return nil, err
+		}
+		if parent.sec != Secure {
+			return parent, nil
+		}
+		z, err = v.cut(ctx, ex, name, parent)
+		if err != nil {
+			return nil, err
+		}
+	}
+	logrus.Debugln("[terasu.dns] dnssec zone of", name, "is", z.apex, z.sec)
+	v.zones.store(name, z, maxZoneTTL)
+	return z, nil
+}
+
+// rootzone validates the root keys by the anchors
+func (v *validator) rootzone(ctx context.Context, ex exchanger) *zone {
+	keys, ttl, sec := v.dnskeys(ctx, ex, ".", v.anchors)
+	return v.newzone(".", sec, keys, ttl)
+}
+
+func (v *validator) newzone(apex string, sec Security, keys []*dnskey, ttl uint32) *zone {
+	d := time.Duration(ttl) * time.Second
+	if d > maxZoneTTL {
+		d = maxZoneTTL
+	}
+	if d <= 0 || (sec != Secure && sec != Insecure) {
+		d = bogusZoneTTL
+	}
+	return &zone{apex: apex, sec: sec, keys: keys, exp: v.now().Add(d)}
+}
+
+// dnskeys fetches the DNSKEYs of apex and validates them by dss
+func (v *validator) dnskeys(ctx context.Context, ex exchanger, apex string, dss []*dsrecord) ([]*dnskey, uint32, Security) {
+	usable := false
+	for _, d := range dss {
+		if supported(d.alg) {
+			usable = true
+			break
+		}
+	}
+	if !usable {
+		// signed only by algorithms we do not know (RFC 4035 5.2)
+		return nil, 0, Insecure
+	}
+	dm, err := v.query(ctx, ex, apex, typeDNSKEY)
+	if err != nil {
+		logrus.Debugln("[terasu.dns] dnssec dnskey of", apex, "err:", err)
+		return nil, 0, Indeterminate
+	}
+	var set *rrset
+	for _, s := range dm.answer {
+		if s.name == apex && s.typ == typeDNSKEY {
+			set = s
+		}
+	}
+	if set == nil {
+		return nil, 0, Bogus
+	}
+	var keys, trusted []*dnskey
+	for _, r := range set.rrs {
+		k, err := parsednskey(r.data)
+		if err != nil || !k.iszonekey() {
+			continue
+		}
+		keys = append(keys, k)
+		for _, d := range dss {
+			if d.matches(apex, k) {
+				trusted = append(trusted, k)
+				break
+			}
+		}
+	}
+	if !verifyset(set, apex, trusted, v.now()) {
+		return nil, 0, Bogus
+	}
+	return keys, minttl(set), Secure
+}
+
+func minttl(set *rrset) uint32 {
+	ttl := set.ttl
+	for _, sig := range set.sigs {
+		if sig.origttl < ttl {
+			ttl = sig.origttl
+		}
+	}
+	return ttl
+}
+
+// cut tells whether name is the apex of a zone under parent by its DS
+func (v *validator) cut(ctx context.Context, ex exchanger, name string, parent *zone) (*zone, error) {
+	dm, err := v.query(ctx, ex, name, typeDS)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range dm.answer {
+		if set.name != name {
+			continue
+		}
+		switch set.typ {
+		case typeDS:
+			if !verifyset(set, parent.apex, parent.keys, v.now()) {
+				return v.newzone(name, Bogus, nil, 0), nil
+			}
+			var dss []*dsrecord
+			for _, r := range set.rrs {
+				if d, err := parseds(r.data); err == nil {
+					dss = append(dss, d)
+				}
+			}
+			keys, ttl, sec := v.dnskeys(ctx, ex, name, dss)
+			if ttl > minttl(set) {
+				ttl = minttl(set)
+			}
+			return v.newzone(name, sec, keys, ttl), nil
+		case typeCNAME:
+			// an alias is never a zone cut
+			return parent, nil
+		}
+	}
+	if !v.verifyauthority(dm, parent) {
+		return v.newzone(name, Bogus, nil, 0), nil
+	}
+	d := deny(dm.authority, name, typeDS, dm.rcode == dnsmessage.RCodeNameError)
+	switch {
+	case !d.proven:
+		return v.newzone(name, Bogus, nil, 0), nil
+	case d.insecure || d.delegation:
+		return v.newzone(name, Insecure, nil, negativettl(dm)), nil
+	}
+	return parent, nil
+}
+
+// verifyauthority checks the NSEC and NSEC3 records by the keys of z
+func (v *validator) verifyauthority(dm *dnssecmsg, z *zone) bool {
+	n := 0
+	for _, set := range dm.authority {
+		if set.typ != typeNSEC && set.typ != typeNSEC3 {
+			continue
+		}
+		if !verifyset(set, z.apex, z.keys, v.now()) {
+			return false
+		}
+		n++
+	}
+	return n > 0
+}
+
+// negativettl is the SOA minimum of dm (RFC 2308 5)
+func negativettl(dm *dnssecmsg) uint32 {
+	for _, set := range dm.authority {
+		if set.typ == typeSOA && len(set.rrs[0].data) >= 4 {
+			d := set.rrs[0].data
+			if m := binary.BigEndian.Uint32(d[len(d)-4:]); m < set.ttl {
+				return m
+			}
+			return set.ttl
+		}
+	}
+	return negativeTTL
+}
+
+// validate the answer msg, ex fetches the DS and DNSKEY records
+func (v *validator) validate(ctx context.Context, ex exchanger, msg []byte) (Security, error) {
+	dm, err := parsednssec(msg)
+	if err != nil {
+		return Indeterminate, err
+	}
+	if dm.rcode != dnsmessage.RCodeSuccess && dm.rcode != dnsmessage.RCodeNameError {
+		return Indeterminate, nil
+	}
+	result := Secure
+	hasdname := false
+	for _, set := range dm.answer {
+		if set.typ == typeDNAME {
+			hasdname = true
+		}
+	}
+	// follow the cnames from the question
+	target, found := dm.qname, false
+	for _, set := range dm.answer {
+		if set.typ == typeCNAME && hasdname && len(set.sigs) == 0 {
+			continue // synthesized from a dname
+		}
+		sec, err := v.validateset(ctx, ex, dm, set)
+		if err != nil {
+			return Indeterminate, err
+		}
+		result = result.worse(sec)
+	}
+	for i := 0; i < len(dm.answer); i++ {
+		for _, set := range dm.answer {
+			if set.name != target {
+				continue
+			}
+			if set.typ == dm.qtype {
+				found = true
+			} else if set.typ == typeCNAME && len(set.rrs) == 1 {
+				target, _, _ = readname(set.rrs[0].data, 0)
+			}
+		}
+	}
+	if !found && dm.qtype != typeCNAME {
+		sec, err := v.validatedenial(ctx, ex, dm, target)
+		if err != nil {
+			return Indeterminate, err
+		}
+		result = result.worse(sec)
+	}
+	return result, nil
+}
+
+// validateset checks the signatures of a positive rrset of dm
+func (v *validator) validateset(ctx context.Context, ex exchanger, dm *dnssecmsg, set *rrset) (Security, error) {
+	if len(set.sigs) == 0 {
+		z, err := v.zoneof(ctx, ex, set.name)
+		if err != nil {
+			return Indeterminate, err
+		}
+		if z.sec == Secure {
+			return Bogus, nil // stripped signatures
+		}
+		return z.sec, nil
+	}
+	signer := set.sigs[0].signer
+	if !issubdomain(set.name, signer) {
+		return Bogus, nil
+	}
+	z, err := v.zoneof(ctx, ex, signer)
+	if err != nil {
+		return Indeterminate, err
+	}
+	if z.sec != Secure {
+		return z.sec, nil
+	}
+	if z.apex != signer {
+		return Bogus, nil
+	}
+	sig := verifysig(set, signer, z.keys, v.now())
+	if sig == nil {
+		return Bogus, nil
+	}
+	if int(sig.labels) == len(labels(set.name)) {
+		return Secure, nil
+	}
+	// expanded from a wildcard, so the name itself must be proven absent
+	var proofs []*rrset
+	for _, a := range dm.authority {
+		if (a.typ == typeNSEC || a.typ == typeNSEC3) && verifyset(a, signer, z.keys, v.now()) {
+			proofs = append(proofs, a)
+		}
+	}
+	d := expanded(proofs, set.name, int(sig.labels))
+	switch {
+	case !d.proven:
+		return Bogus, nil
+	case d.insecure:
+		return Insecure, nil
+	}
+	return Secure, nil
+}
+
+// validatedenial checks that name has no record of the question type
+func (v *validator) validatedenial(ctx context.Context, ex exchanger, dm *dnssecmsg, name string) (Security, error) {
+	signer := ""
+	for _, set := range dm.authority {
+		if len(set.sigs) > 0 {
+			signer = set.sigs[0].signer
+			break
+		}
+	}
+	if signer == "" || !issubdomain(name, signer) {
+		z, err := v.zoneof(ctx, ex, name)
+		if err != nil {
+			return Indeterminate, err
+		}
+		if z.sec == Secure {
+			return Bogus, nil
+		}
+		return z.sec, nil
+	}
+	z, err := v.zoneof(ctx, ex, signer)
+	if err != nil {
+		return Indeterminate, err
+	}
+	if z.sec != Secure {
+		return z.sec, nil
+	}
+	if z.apex != signer || !v.verifyauthority(dm, z) {
+		return Bogus, nil
+	}
+	d := deny(dm.authority, name, dm.qtype, dm.rcode == dnsmessage.RCodeNameError)
+	switch {
+	case !d.proven:
+		return Bogus, nil
+	case d.insecure:
+		return Insecure, nil
+	}
+	return Secure, nil
+}
+
+// checkingdisabled tells whether the CD bit of q is set
+func checkingdisabled(q []byte) bool {
+	return len(q) > 3 && q[3]&0x10 != 0
+}
+
+// withdnssecok sets the DO bit of q, adding an EDNS(0) record if needed
+func withdnssecok(q []byte) ([]byte, error) {
+	var m dnsmessage.Message
+	err := m.Unpack(q)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = optof(&m); err != nil {
+		return nil, err
+	}
+	for i := range m.Additionals {
+		if m.Additionals[i].Header.Type == dnsmessage.TypeOPT {
+			m.Additionals[i].Header.TTL |= 0x8000
+		}
+	}
+	return m.Pack()
+}
+
+// stripdnssec removes the DNSSEC records the client did not ask for
+func stripdnssec(msg []byte) ([]byte, error) {
+	var m dnsmessage.Message
+	err := m.Unpack(msg)
+	if err != nil {
+		return nil, err
+	}
+	strip := func(rs []dnsmessage.Resource) []dnsmessage.Resource {
+		n := rs[:0]
+		for _, r := range rs {
+			switch r.Header.Type {
+			case typeRRSIG, typeNSEC, typeNSEC3:
+				continue
+			case dnsmessage.TypeOPT:
+				r.Header.TTL &^= 0x8000
+			}
+			n = append(n, r)
+		}
+		return n
+	}
+	m.Answers = strip(m.Answers)
+	m.Authorities = strip(m.Authorities)
+	m.Additionals = strip(m.Additionals)
+	return m.Pack()
+}
+
+// secure exchanges q by ex with the DO bit and validates the answer,
+// its AD bit tells whether the answer is secure
+func (s *serverset) secure(ctx context.Context, q []byte, ex exchanger) ([]byte, error) {
+	if !s.dnssec.Validate || checkingdisabled(q) {
+		return ex(ctx, q)
+	}
+	qi, err := parsequery(q)
+	if err != nil {
+		return nil, err
+	}
+	do := qi.dnssecok()
+	if !do {
+		q, err = withdnssecok(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err := ex(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	// the sub queries have the CD bit and do not come back here
+	sec, err := s.validatorof().validate(ctx, ex, resp)
+	if err != nil {
+		logrus.Debugln("[terasu.dns] dnssec", qi.question.Name, "err:", err)
+	}
+	if sec == Bogus {
+		logrus.Warnln("[terasu.dns] dnssec bogus answer of", qi.question.Name)
+		if s.dnssec.Strict {
+			return nil, ErrBogus
+		}
+	}
+	if !do {
+		resp, err = stripdnssec(resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sec == Secure {
+		resp[3] |= 0x20 // AD bit
+	} else {
+		resp[3] &^= 0x20
+	}
+	return resp, nil
+}
+
+// LookupSecure looks up the addresses of host with their DNSSEC status,
+// a bogus answer is an error in strict mode. DoH servers are not used.
+func (ds *DNSList) LookupSecure(ctx context.Context, host string) ([]string, Security, error) {
+	host, err := ToASCII(host)
+	if err != nil {
+		return nil, Indeterminate, err
+	}
+	s := ds.load()
+	v := s.validatorof()
+	var addrs []string
+	result := Secure
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		q, qerr := dnssecquery(host, uint16(typ))
+		if qerr != nil {
+			return nil, Indeterminate, qerr
+		}
+		resp, xerr := ds.exchange(ctx, q)
+		if xerr != nil {
+			err = xerr
+			result = result.worse(Indeterminate)
+			continue
+		}
+		sec, verr := v.validate(ctx, ds.exchange, resp)
+		if verr != nil {
+			logrus.Debugln("[terasu.dns] dnssec", host, typ, "err:", verr)
+		}
+		if sec == Bogus && s.dnssec.Strict {
+			return nil, Bogus, ErrBogus
+		}
+		result = result.worse(sec)
+		addrs = append(addrs, answeraddrs(resp)...)
+	}
+	if len(addrs) == 0 {
+		if err == nil {
+			err = ErrEmptyHostAddress
+		}
+		return nil, result, err
+	}
+	return addrs, result, nil
+}
@@ -0,0 +1,306 @@
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSKEYTag(t *testing.T) {
+	// dskey.example.com of RFC 4034 5.4
+	pub, err := base64.StdEncoding.DecodeString("AQOeiiR0GOMYkDshWoSKz9XzfwJr1AYtsmx3TGkJaNXVbfi/2pHm822aJ5iI9BMzNXxeYCmZDRD99WYwYqUSdjMmmAphXdvxegXd/M5+X7OrzKBaMbCVdFLUUh6DhweJBjEVv5f2wwjM9XzcnOf+EPbtG9DMBmADjFDc2w/rljwvFw==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := parsednskey(append([]byte{1, 0, 3, 5}, pub...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.keytag != 60485 {
+		t.Fatal("unexpected key tag", k.keytag)
+	}
+	digest, _ := hex.DecodeString("2BB183AF5F22588179A53B0A98631FAD1A292118")
+	ds := &dsrecord{keytag: 60485, alg: 5, digesttype: digestSHA1, digest: digest}
+	if !ds.matches("dskey.example.com.", k) {
+		t.Fatal("ds mismatch")
+	}
+}
+
+// testzone signs the records of apex by a single P-256 key
+type testzone struct {
+	apex string
+	key  *ecdsa.PrivateKey
+	rd   []byte // rd is the DNSKEY rdata
+}
+
+func newtestzone(t *testing.T, apex string) *testzone {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := []byte{1, 1, 3, algECDSAP256SHA256}
+	rd = append(rd, key.PublicKey.X.FillBytes(make([]byte, 32))...)
+	rd = append(rd, key.PublicKey.Y.FillBytes(make([]byte, 32))...)
+	return &testzone{apex: apex, key: key, rd: rd}
+}
+
+// ds of the key of z
+func (z *testzone) ds() []byte {
+	h := sha256.New()
+	h.Write(appendname(nil, z.apex))
+	h.Write(z.rd)
+	b := binary.BigEndian.AppendUint16(nil, keytag(z.rd))
+	b = append(b, algECDSAP256SHA256, digestSHA256)
+	return h.Sum(b)
+}
+
+func (z *testzone) anchor() string {
+	d := z.ds()
+	return strconv.Itoa(int(binary.BigEndian.Uint16(d))) + " 13 2 " + hex.EncodeToString(d[4:])
+}
+
+func testrr(name string, typ uint16, data []byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: dnsmessage.Type(typ), Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.UnknownResource{Type: dnsmessage.Type(typ), Data: data},
+	}
+}
+
+// sign the rrset of name in typ, returning the records and the RRSIG
+func (z *testzone) sign(t *testing.T, name string, typ uint16, datas ...[]byte) []dnsmessage.Resource {
+	return z.signlabels(t, name, len(labels(name)), typ, datas...)
+}
+
+// signlabels signs as if name were expanded from a wildcard of n labels
+func (z *testzone) signlabels(t *testing.T, name string, n int, typ uint16, datas ...[]byte) []dnsmessage.Resource {
+	set := &rrset{name: name, typ: typ}
+	var rs []dnsmessage.Resource
+	for _, d := range datas {
+		set.rrs = append(set.rrs, rr{name: name, typ: typ, class: 1, data: d})
+		rs = append(rs, testrr(name, typ, d))
+	}
+	now := uint32(time.Now().Unix())
+	head := binary.BigEndian.AppendUint16(nil, typ)
+	head = append(head, algECDSAP256SHA256, byte(n))
+	head = binary.BigEndian.AppendUint32(head, 300)
+	head = binary.BigEndian.AppendUint32(head, now+3600)
+	head = binary.BigEndian.AppendUint32(head, now-3600)
+	head = binary.BigEndian.AppendUint16(head, keytag(z.rd))
+	sig, err := parserrsig(appendname(head, z.apex))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256(sig.signeddata(set))
+	r, s, err := ecdsa.Sign(rand.Reader, z.key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append(sig.signed, r.FillBytes(make([]byte, 32))...)
+	data = append(data, s.FillBytes(make([]byte, 32))...)
+	return append(rs, testrr(name, typeRRSIG, data))
+}
+
+// nsecdata of next with the types in the first window
+func nsecdata(next string, types ...uint16) []byte {
+	bm := make([]byte, 32)
+	n := 0
+	for _, typ := range types {
+		bm[typ/8] |= 0x80 >> (typ % 8)
+		if int(typ/8)+1 > n {
+			n = int(typ/8) + 1
+		}
+	}
+	b := appendname(nil, next)
+	b = append(b, 0, byte(n))
+	return append(b, bm[:n]...)
+}
+
+type testanswer struct {
+	rcode     dnsmessage.RCode
+	answer    []dnsmessage.Resource
+	authority []dnsmessage.Resource
+}
+
+// testuniverse is a signed root with test., where insecure.test.
+// is an unsigned delegation, answering as a recursive resolver
+func testuniverse(t *testing.T) (string, exchanger) {
+	root, tld := newtestzone(t, "."), newtestzone(t, "test.")
+	a := []byte{192, 0, 2, 1}
+	const A, NS, RRSIG, NSEC = 1, 2, typeRRSIG, typeNSEC
+	table := map[string]testanswer{
+		". 48":       {answer: root.sign(t, ".", typeDNSKEY, root.rd)},
+		"test. 43":   {answer: root.sign(t, "test.", typeDS, tld.ds())},
+		"test. 48":   {answer: tld.sign(t, "test.", typeDNSKEY, tld.rd)},
+		"a.test. 1":  {answer: tld.sign(t, "a.test.", A, a)},
+		"a.test. 28": {authority: tld.sign(t, "a.test.", NSEC, nsecdata("bogus.test.", A, RRSIG, NSEC))},
+		"a.test. 43": {authority: tld.sign(t, "a.test.", NSEC, nsecdata("bogus.test.", A, RRSIG, NSEC))},
+		"bogus.test. 1": {answer: func() []dnsmessage.Resource {
+			rs := tld.sign(t, "bogus.test.", A, a)
+			rs[0].Body.(*dnsmessage.UnknownResource).Data = []byte{192, 0, 2, 66}
+			return rs
+		}()},
+		"insecure.test. 43":     {authority: tld.sign(t, "insecure.test.", NSEC, nsecdata("stripped.test.", NS, RRSIG, NSEC))},
+		"www.insecure.test. 1":  {answer: []dnsmessage.Resource{testrr("www.insecure.test.", A, a)}},
+		"www.insecure.test. 28": {},
+		"stripped.test. 1":      {answer: []dnsmessage.Resource{testrr("stripped.test.", A, a)}},
+		"stripped.test. 43":     {authority: tld.sign(t, "stripped.test.", NSEC, nsecdata("test.", A, RRSIG, NSEC))},
+		"nx.test. 1": {rcode: dnsmessage.RCodeNameError, authority: append(
+			tld.sign(t, "insecure.test.", NSEC, nsecdata("stripped.test.", NS, RRSIG, NSEC)),
+			tld.sign(t, "test.", NSEC, nsecdata("a.test.", NS, 6, RRSIG, NSEC, typeDNSKEY))...,
+		)},
+		// *.test. expands to the names beyond stripped.test.
+		"w.wild.test. 1": {
+			answer:    tld.signlabels(t, "w.wild.test.", 1, A, a),
+			authority: tld.sign(t, "stripped.test.", NSEC, nsecdata("test.", A, RRSIG, NSEC)),
+		},
+		"x.wild.test. 1": {answer: tld.signlabels(t, "x.wild.test.", 1, A, a)},
+		"fakenx.test. 1": {rcode: dnsmessage.RCodeNameError, authority: tld.sign(t, "test.", NSEC, nsecdata("a.test.", NS, 6, RRSIG, NSEC, typeDNSKEY))},
+	}
+	ex := func(ctx context.Context, q []byte) ([]byte, error) {
+		var m dnsmessage.Message
+		if err := m.Unpack(q); err != nil {
+			return nil, err
+		}
+		qs := m.Questions[0]
+		ans, ok := table[strings.ToLower(qs.Name.String())+" "+strconv.Itoa(int(qs.Type))]
+		if !ok {
+			return nil, errors.New("no test answer of " + qs.Name.String() + " " + qs.Type.String())
+		}
+		m.Response, m.RCode = true, ans.rcode
+		m.Answers, m.Authorities = ans.answer, ans.authority
+		return m.Pack()
+	}
+	return root.anchor(), ex
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	anchor, ex := testuniverse(t)
+	v, err := newvalidator([]string{anchor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		sec  Security
+	}{
+		{"a.test", Secure},
+		{"www.insecure.test", Insecure},
+		{"bogus.test", Bogus},
+		{"stripped.test", Bogus},
+		{"nx.test", Secure},
+		{"fakenx.test", Bogus},
+		{"w.wild.test", Secure},
+		{"x.wild.test", Bogus},
+	} {
+		q, err := dnssecquery(c.name, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ex(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sec, err := v.validate(context.Background(), ex, resp)
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		if sec != c.sec {
+			t.Fatal(c.name, "unexpected", sec)
+		}
+	}
+	// the expired zones are fetched again
+	v.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if z, err := v.zoneof(context.Background(), ex, "test."); err != nil || z.sec != Bogus {
+		t.Fatal("signatures should have expired", z, err)
+	}
+	if _, err = newvalidator([]string{"20326 8 2 xyz"}); err != ErrInvalidAnchor {
+		t.Fatal("unexpected", err)
+	}
+}
+
+func TestDNSSECStrict(t *testing.T) {
+	anchor, ex := testuniverse(t)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp, err := ex(context.Background(), buf[:n])
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"local": {"udp://" + conn.LocalAddr().String()}}})
+	if err = ds.SetDNSSEC(DNSSECConfig{Validate: true, Strict: true, Anchors: []string{anchor}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := newquery(1, "a.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ds.exchange(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err = m.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if !m.AuthenticData || len(m.Answers) != 1 {
+		t.Fatal("unexpected", m.AuthenticData, m.Answers)
+	}
+	addrs, sec, err := ds.LookupSecure(context.Background(), "a.test")
+	if err != nil || sec != Secure || len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("unexpected", addrs, sec, err)
+	}
+	if _, sec, err = ds.LookupSecure(context.Background(), "www.insecure.test"); err != nil || sec != Insecure {
+		t.Fatal("unexpected", sec, err)
+	}
+	q, err = newquery(1, "bogus.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ds.exchange(context.Background(), q); !errors.Is(err, ErrNoDNSAvailable) && !errors.Is(err, ErrBogus) {
+		t.Fatal("unexpected", err)
+	}
+	if st := ds.Snapshot(); st[0].Failure == 0 {
+		t.Fatal("bogus server not penalized", st)
+	}
+}
+
+func TestNSEC3Hash(t *testing.T) {
+	// RFC 5155 appendix A
+	salt, _ := hex.DecodeString("aabbccdd")
+	for name, want := range map[string]string{
+		"example.":   "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom",
+		"a.example.": "35mthgpgcu1qg68fab165klnsnk3dpvl",
+	} {
+		if h := strings.ToLower(nsec3Encoding.EncodeToString(nsec3hash(name, salt, 12))); h != want {
+			t.Fatal(name, "unexpected", h)
+		}
+	}
+}
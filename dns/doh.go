@@ -1,20 +1,25 @@
 package dns
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 
+	"golang.org/x/net/dns/dnsmessage"
 	"golang.org/x/net/http2"
 
 	"github.com/fumiama/terasu"
-	"github.com/fumiama/terasu/ip"
+	"github.com/sirupsen/logrus"
 )
 
 var (
@@ -23,29 +28,35 @@ var (
 
 type recordType uint16
 
+const dnsMessageMIME = "application/dns-message"
+
 const (
 	recordTypeNone recordType = 0
 	recordTypeA    recordType = 1
 	recordTypeAAAA recordType = 28
 )
 
+type dohjsonquestion struct {
+	Name string     `json:"name"`
+	Type recordType `json:"type"`
+}
+
+type dohjsonanswer struct {
+	Name string     `json:"name"`
+	Type recordType `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
 type dohjsonresponse struct {
-	Status   uint32
-	TC       bool
-	RD       bool
-	RA       bool
-	AD       bool
-	CD       bool
-	Question []struct {
-		Name string     `json:"name"`
-		Type recordType `json:"type"`
-	}
-	Answer []struct {
-		Name string     `json:"name"`
-		Type recordType `json:"type"`
-		TTL  uint16
-		Data string `json:"data"`
-	}
+	Status           uint32
+	TC               bool
+	RD               bool
+	RA               bool
+	AD               bool
+	CD               bool
+	Question         []dohjsonquestion
+	Answer           []dohjsonanswer
 	EdnsClientSubnet string `json:"edns_client_subnet"`
 	Comment          string
 }
@@ -63,85 +74,156 @@ func (jr *dohjsonresponse) hosts() []string {
 	return hosts
 }
 
+// trsHTTP2ClientWithSystemDNS resolves DoH hosts by bootstrap,
+// which falls back to the system DNS, for queries out of any list.
 var trsHTTP2ClientWithSystemDNS = http.Client{
 	Transport: &http2.Transport{
 		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
-			host, port, err := net.SplitHostPort(addr)
-			if err != nil {
-				return nil, err
-			}
-			addrs := lookupTable.Get(host)
-			if len(addrs) == 0 {
-				addrs, err = net.DefaultResolver.LookupHost(ctx, host)
-				if err != nil {
-					return nil, err
-				}
-				lookupTable.Set(host, addrs)
-			}
-			if len(addr) == 0 {
-				return nil, ErrEmptyHostAddress
-			}
-			var conn net.Conn
-			var tlsConn *tls.Conn
-			for _, a := range addrs {
-				conn, err = dnsDialer.DialContext(ctx, network, net.JoinHostPort(a, port))
-				if err != nil {
-					continue
-				}
-				tlsConn = tls.Client(conn, cfg)
-				if terasu.DefaultFirstFragmentLen > 0 {
-					err = terasu.Use(tlsConn).HandshakeContext(ctx, terasu.DefaultFirstFragmentLen)
-				} else {
-					err = tlsConn.HandshakeContext(ctx)
-				}
-				if err == nil {
-					break
-				}
-				_ = tlsConn.Close()
-				tlsConn = nil
-				conn, err = dnsDialer.DialContext(ctx, network, net.JoinHostPort(a, port))
-				if err != nil {
-					continue
-				}
-				tlsConn = tls.Client(conn, cfg)
-				err = tlsConn.HandshakeContext(ctx)
-				if err == nil {
-					break
-				}
-				_ = tlsConn.Close()
-				tlsConn = nil
-			}
-			return tlsConn, err
+			return dialdoh(ctx, network, addr, cfg, nil)
 		},
 	},
 }
 
-func lookupdoh(ctx context.Context, server, u string) (jr dohjsonresponse, err error) {
-	jr, err = lookupdohwithtype(ctx, server, u, preferreddohtype())
-	if err == nil {
-		return
+// dohClients caches clients of upstreams with TLS options by Upstream.String()
+var dohClients sync.Map
+
+// dohclient returns the client honouring the TLS options of up.
+// The clients of a list are kept in it by strictness so that their
+// pooled connections never serve another list or strictness.
+func dohclient(ctx context.Context, up *Upstream) *http.Client {
+	ds, strict := bootstrapof(ctx)
+	if ds == nil && !up.hastlsoptions() {
+		return &trsHTTP2ClientWithSystemDNS
 	}
-	if ip.IsIPv6Available {
-		jr, err = lookupdohwithtype(ctx, server, u, recordTypeA)
+	clients, key := &dohClients, up.String()
+	if ds != nil {
+		clients, key = &ds.doh, fmt.Sprint(strict, " ", key)
 	}
+	if c, ok := clients.Load(key); ok {
+		return c.(*http.Client)
+	}
+	c, _ := clients.LoadOrStore(key, &http.Client{
+		Transport: &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				if ds != nil {
+					ctx = withbootstrap(ctx, ds)
+				}
+				return dialdoh(ctx, network, addr, cfg, up)
+			},
+		},
+	})
+	return c.(*http.Client)
+}
+
+// dialdoh dials addr of a DoH server with the TLS options of up if not nil
+func dialdoh(ctx context.Context, network, addr string, cfg *tls.Config, up *Upstream) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := bootstrap(ctx, host, up)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, ErrEmptyHostAddress
+	}
+	firstFragmentLen := terasu.DefaultFirstFragmentLen
+	if up != nil {
+		cfg = up.tlsconfig(cfg)
+		firstFragmentLen = up.fragment(firstFragmentLen)
+	}
+	var conn net.Conn
+	var tlsConn *tls.Conn
+	for _, a := range addrs {
+		conn, err = dnsDialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err != nil {
+			continue
+		}
+		tlsConn = tls.Client(conn, cfg)
+		if firstFragmentLen > 0 {
+			err = terasu.Use(tlsConn).HandshakeContext(ctx, firstFragmentLen)
+		} else {
+			err = tlsConn.HandshakeContext(ctx)
+		}
+		if err == nil {
+			break
+		}
+		_ = tlsConn.Close()
+		tlsConn = nil
+		if errors.Is(err, ErrPinMismatch) || errors.Is(err, ErrCertHashMismatch) {
+			continue
+		}
+		conn, err = dnsDialer.DialContext(ctx, network, net.JoinHostPort(a, port))
+		if err != nil {
+			continue
+		}
+		tlsConn = tls.Client(conn, cfg)
+		err = tlsConn.HandshakeContext(ctx)
+		if err == nil {
+			break
+		}
+		_ = tlsConn.Close()
+		tlsConn = nil
+	}
+	return tlsConn, err
+}
+
+// lookupdoh queries A and AAAA of u concurrently and merges
+// the answers, it fails only if both queries failed
+func lookupdoh(ctx context.Context, server *Upstream, u string) (jr dohjsonresponse, err error) {
+	type result struct {
+		jr  dohjsonresponse
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		jr, err := lookupdohwithtype(ctx, server, u, recordTypeAAAA)
+		ch <- result{jr: jr, err: err}
+	}()
+	jr, err = lookupdohwithtype(ctx, server, u, recordTypeA)
+	r6 := <-ch
+	if err != nil {
+		logrus.Debugln("[terasu.dns] -- doh", server.URL, "A of", u, "err:", err)
+		return r6.jr, r6.err
+	}
+	if r6.err != nil {
+		logrus.Debugln("[terasu.dns] -- doh", server.URL, "AAAA of", u, "err:", r6.err)
+		return
+	}
+	jr.Question = append(jr.Question, r6.jr.Question...)
+	jr.Answer = append(jr.Answer, r6.jr.Answer...)
 	return
 }
 
-func lookupdohwithtype(ctx context.Context, server, u string, typ recordType) (jr dohjsonresponse, err error) {
+func lookupdohwithtype(ctx context.Context, server *Upstream, u string, typ recordType) (jr dohjsonresponse, err error) {
+	if server.Format == DoHFormatWire {
+		return lookupdohwire(ctx, server, u, typ)
+	}
 	sb := strings.Builder{}
-	sb.WriteString(server)
-	sb.WriteString("?name=")
+	sb.WriteString(server.URL)
+	if strings.Contains(server.URL, "?") {
+		sb.WriteString("&name=")
+	} else {
+		sb.WriteString("?name=")
+	}
 	sb.WriteString(url.QueryEscape(u))
 	if typ != recordTypeNone {
 		sb.WriteString("&type=")
 		sb.WriteString(strconv.Itoa(int(typ)))
 	}
+	if e := ecsof(ctx, server); e != nil {
+		if p, ok := e.prefix(server.Host); ok {
+			sb.WriteString("&edns_client_subnet=")
+			sb.WriteString(url.QueryEscape(p.String()))
+		}
+	}
 	req, err := http.NewRequestWithContext(ctx, "GET", sb.String(), nil)
 	if err != nil {
 		return
 	}
 	req.Header.Add("accept", "application/dns-json")
-	resp, err := trsHTTP2ClientWithSystemDNS.Do(req)
+	resp, err := dohclient(ctx, server).Do(req)
 	if err != nil {
 		return
 	}
@@ -156,9 +238,46 @@ func lookupdohwithtype(ctx context.Context, server, u string, typ recordType) (j
 	return
 }
 
-func preferreddohtype() recordType {
-	if ip.IsIPv6Available {
-		return recordTypeAAAA
+// lookupdohwire posts an RFC 8484 query
+func lookupdohwire(ctx context.Context, server *Upstream, u string, typ recordType) (jr dohjsonresponse, err error) {
+	if typ == recordTypeNone {
+		typ = recordTypeA
+	}
+	// id 0 is recommended for caching (RFC 8484 4.1)
+	q, err := newquery(0, u, dnsmessage.Type(typ))
+	if err != nil {
+		return
+	}
+	msg, err := exchangedoh(ctx, server, q)
+	if err != nil {
+		return
+	}
+	return parseresponse(msg)
+}
+
+// exchangedoh posts the wire query q and returns the wire response
+func exchangedoh(ctx context.Context, server *Upstream, q []byte) ([]byte, error) {
+	q, err := applyecs(ctx, server, q)
+	if err != nil {
+		return nil, err
+	}
+	q, err = applypadding(server, q)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", server.URL, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("content-type", dnsMessageMIME)
+	req.Header.Add("accept", dnsMessageMIME)
+	resp, err := dohclient(ctx, server).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("status: " + resp.Status)
 	}
-	return recordTypeA
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
 }
@@ -0,0 +1,196 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// ecsOptionCode is the EDNS(0) option of client subnet (RFC 7871)
+	ecsOptionCode = 8
+	// ecsAuto derives the subnet from the egress address
+	ecsAuto = "auto"
+	// privacy prefix lengths recommended by RFC 7871 11.1
+	ecsIPv4Bits = 24
+	ecsIPv6Bits = 56
+)
+
+var (
+	// ErrInvalidECS is reported on malformed client subnets
+	ErrInvalidECS = errors.New("invalid client subnet")
+)
+
+// ECS is an EDNS Client Subnet setting. A zero prefix such as 0.0.0.0/0
+// asks the resolver not to use our location at all.
+type ECS struct {
+	Prefix netip.Prefix
+	// Auto derives the prefix from the egress address. Only a public
+	// local source address is detected, so behind NAT it sends nothing
+	// until the public address is given by SetEgressIP.
+	Auto bool
+}
+
+// ParseECS parses auto or a prefix like 1.2.3.0/24, an address
+// without length is truncated to /24 or /56 for privacy
+func ParseECS(s string) (*ECS, error) {
+	if s == ecsAuto {
+		return &ECS{Auto: true}, nil
+	}
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return nil, ErrInvalidECS
+		}
+		return &ECS{Prefix: privacyprefix(a)}, nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, ErrInvalidECS
+	}
+	return &ECS{Prefix: p.Masked()}, nil
+}
+
+func (e *ECS) String() string {
+	if e.Auto {
+		return ecsAuto
+	}
+	return e.Prefix.String()
+}
+
+func privacyprefix(a netip.Addr) netip.Prefix {
+	a = a.Unmap()
+	bits := ecsIPv6Bits
+	if a.Is4() {
+		bits = ecsIPv4Bits
+	}
+	p, _ := a.Prefix(bits)
+	return p
+}
+
+var egressIP atomic.Pointer[netip.Addr]
+
+// SetEgressIP sets the public address for the auto client subnet,
+// which is required behind NAT as it is never discovered remotely.
+// An invalid address restores detection by the local source address.
+func SetEgressIP(a netip.Addr) {
+	if !a.IsValid() {
+		egressIP.Store(nil)
+		return
+	}
+	egressIP.Store(&a)
+}
+
+// prefix to be sent to a server at host, false means sending nothing
+func (e *ECS) prefix(host string) (netip.Prefix, bool) {
+	if !e.Auto {
+		return e.Prefix, e.Prefix.IsValid()
+	}
+	if a := egressIP.Load(); a != nil {
+		return privacyprefix(*a), true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	dst, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		dst = netip.MustParseAddr("1.1.1.1")
+	}
+	src := sourceaddr(dst)
+	// a private source is not where the resolver sees us
+	if !src.IsValid() || !src.IsGlobalUnicast() || src.IsPrivate() {
+		logrus.Debugln("[terasu.dns] no public source address for auto ecs, call SetEgressIP behind NAT")
+		return netip.Prefix{}, false
+	}
+	return privacyprefix(src), true
+}
+
+type ecskey struct{}
+
+// WithECS sets the client subnet of the queries under ctx,
+// which overrides the ecs option of upstreams
+func WithECS(ctx context.Context, e *ECS) context.Context {
+	return context.WithValue(ctx, ecskey{}, e)
+}
+
+// ecsname tells apart the lookups of host by the client subnet of ctx
+func ecsname(ctx context.Context, host string) string {
+	e, ok := ctx.Value(ecskey{}).(*ECS)
+	switch {
+	case !ok || e == nil:
+		return host
+	case e.Auto:
+		return host + " ecs=" + ecsAuto
+	}
+	return host + " ecs=" + e.Prefix.String()
+}
+
+// ecsof is the setting of ctx or else of up
+func ecsof(ctx context.Context, up *Upstream) *ECS {
+	if e, ok := ctx.Value(ecskey{}).(*ECS); ok {
+		return e
+	}
+	return up.ECS
+}
+
+// ecsoption encodes p as the EDNS(0) option (RFC 7871 6)
+func ecsoption(p netip.Prefix) dnsmessage.Option {
+	a := p.Addr()
+	family := uint16(2)
+	var addr []byte
+	if a.Is4() {
+		family = 1
+		b := a.As4()
+		addr = b[:]
+	} else {
+		b := a.As16()
+		addr = b[:]
+	}
+	bits := p.Bits()
+	data := make([]byte, 4, 4+(bits+7)/8)
+	data[0], data[1] = byte(family>>8), byte(family)
+	data[2] = byte(bits)
+	data = append(data, addr[:(bits+7)/8]...)
+	return dnsmessage.Option{Code: ecsOptionCode, Data: data}
+}
+
+// withecs replaces the client subnet of the wire query q by p,
+// adding an EDNS(0) record if there is none
+func withecs(q []byte, p netip.Prefix) ([]byte, error) {
+	var m dnsmessage.Message
+	err := m.Unpack(q)
+	if err != nil {
+		return nil, err
+	}
+	opt, err := optof(&m)
+	if err != nil {
+		return nil, err
+	}
+	options := opt.Options[:0]
+	for _, o := range opt.Options {
+		if o.Code != ecsOptionCode {
+			options = append(options, o)
+		}
+	}
+	opt.Options = append(options, ecsoption(p))
+	return m.Pack()
+}
+
+// applyecs sets the client subnet of ctx or up to q if any
+func applyecs(ctx context.Context, up *Upstream, q []byte) ([]byte, error) {
+	e := ecsof(ctx, up)
+	if e == nil {
+		return q, nil
+	}
+	p, ok := e.prefix(up.Host)
+	if !ok {
+		return q, nil
+	}
+	return withecs(q, p)
+}
@@ -0,0 +1,136 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ecsdata is the client subnet option data of msg, nil if none
+func ecsdata(t *testing.T, msg []byte) []byte {
+	qi, err := parsequery(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if qi.opt == nil {
+		return nil
+	}
+	var data []byte
+	for _, o := range qi.opt.Body.(*dnsmessage.OPTResource).Options {
+		if o.Code == ecsOptionCode {
+			if data != nil {
+				t.Fatal("duplicated ecs option")
+			}
+			data = o.Data
+		}
+	}
+	return data
+}
+
+func TestECSOption(t *testing.T) {
+	q, err := newquery(1, "ecs.terasu.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		in   string
+		data []byte
+	}{
+		{"192.0.2.77", []byte{0, 1, 24, 0, 192, 0, 2}},
+		{"0.0.0.0/0", []byte{0, 1, 0, 0}},
+		{"198.51.100.0/22", []byte{0, 1, 22, 0, 198, 51, 100}},
+		{"2001:db8:1:2:3::1", []byte{0, 2, 56, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1, 0}},
+	} {
+		e, err := ParseECS(c.in)
+		if err != nil {
+			t.Fatal(c.in, err)
+		}
+		q, err = withecs(q, e.Prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := ecsdata(t, q); !bytes.Equal(d, c.data) {
+			t.Fatalf("%s: unexpected %v", c.in, d)
+		}
+	}
+	for _, in := range []string{"", "192.0.2.0/33", "ecs.terasu.test"} {
+		if _, err = ParseECS(in); err == nil {
+			t.Fatal("expected error on", in)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/dns-query?name=ecs.terasu.test&edns_client_subnet=192.0.2.0/24", nil)
+	q, err = jsonquery(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := ecsdata(t, q); !bytes.Equal(d, []byte{0, 1, 24, 0, 192, 0, 2}) {
+		t.Fatal("unexpected", d)
+	}
+}
+
+func TestECSUpstream(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	seen := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			seen <- append([]byte(nil), buf[:n]...)
+			resp, err := fakeresponse(buf[:n], fakeanswer("192.0.2.1", ""))
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+
+	stat, err := newdnsstat("udp://" + conn.LocalAddr().String() + "?ecs=192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.up.String() != "udp://"+conn.LocalAddr().String()+"?ecs=192.0.2.0%2F24" {
+		t.Fatal("unexpected", stat.up)
+	}
+	r := racer{host: "local", addr: stat}
+	s := &serverset{}
+	q, err := newquery(1, "ecs.terasu.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.exchange(context.Background(), q, s); err != nil {
+		t.Fatal(err)
+	}
+	if d := ecsdata(t, <-seen); !bytes.Equal(d, []byte{0, 1, 24, 0, 192, 0, 2}) {
+		t.Fatal("unexpected", d)
+	}
+	ctx := WithECS(context.Background(), &ECS{Prefix: netip.MustParsePrefix("0.0.0.0/0")})
+	if _, err = r.exchange(ctx, q, s); err != nil {
+		t.Fatal(err)
+	}
+	if d := ecsdata(t, <-seen); !bytes.Equal(d, []byte{0, 1, 0, 0}) {
+		t.Fatal("unexpected", d)
+	}
+
+	SetEgressIP(netip.MustParseAddr("203.0.113.9"))
+	defer SetEgressIP(netip.Addr{})
+	ctx = WithECS(context.Background(), &ECS{Auto: true})
+	if _, err = r.exchange(ctx, q, s); err != nil {
+		t.Fatal(err)
+	}
+	if d := ecsdata(t, <-seen); !bytes.Equal(d, []byte{0, 1, 24, 0, 203, 0, 113}) {
+		t.Fatal("unexpected", d)
+	}
+}
@@ -0,0 +1,86 @@
+package dns
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightcall is an in-flight or completed lookup shared by callers
+type flightcall struct {
+	done    chan struct{}
+	addrs   []string
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightgroup collapses concurrent lookups of the same key into one
+type flightgroup struct {
+	mu sync.Mutex
+	m  map[string]*flightcall
+}
+
+var lookupGroup flightgroup
+
+// detachedctx keeps the values of its parent but never expires,
+// so that one caller giving up won't cancel the shared lookup.
+type detachedctx struct{ context.Context }
+
+func (detachedctx) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedctx) Done() <-chan struct{}       { return nil }
+func (detachedctx) Err() error                  { return nil }
+
+// do calls fn once for all concurrent callers of key and gives each a copy
+// of the result. The ctx passed to fn is canceled only after every caller
+// has given up.
+func (g *flightgroup) do(
+	ctx context.Context, key string, fn func(ctx context.Context) ([]string, error),
+) ([]string, error) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = map[string]*flightcall{}
+	}
+	c, ok := g.m[key]
+	if ok {
+		c.waiters++
+	} else {
+		fctx, cancel := context.WithCancel(detachedctx{ctx})
+		c = &flightcall{done: make(chan struct{}), waiters: 1, cancel: cancel}
+		g.m[key] = c
+		go g.run(fctx, key, c, fn)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		if c.err != nil {
+			return nil, c.err
+		}
+		return append([]string(nil), c.addrs...), nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flightgroup) run(
+	ctx context.Context, key string, c *flightcall, fn func(ctx context.Context) ([]string, error),
+) {
+	c.addrs, c.err = fn(ctx)
+	g.mu.Lock()
+	if g.m[key] == c {
+		delete(g.m, key)
+	}
+	g.mu.Unlock()
+	c.cancel()
+	close(c.done)
+}
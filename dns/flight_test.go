@@ -0,0 +1,89 @@
+package dns
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupShare(t *testing.T) {
+	var g flightgroup
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) ([]string, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []string{"192.0.2.1"}, nil
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := g.do(context.Background(), "ip shared.terasu.test", fn)
+			if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+				t.Error("unexpected result", addrs, err)
+				return
+			}
+			addrs[0] = "203.0.113.1" // each caller owns its copy
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatal("expected 1 call but got", calls)
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	var g flightgroup
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) ([]string, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { _, err := g.do(ctx1, "ip cancel.terasu.test", fn); errs <- err }()
+	go func() { _, err := g.do(ctx2, "ip cancel.terasu.test", fn); errs <- err }()
+	time.Sleep(time.Millisecond * 50)
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal("unexpected err", err)
+	}
+	select {
+	case <-canceled:
+		t.Fatal("shared lookup canceled by one caller")
+	case <-time.After(time.Millisecond * 50):
+	}
+	cancel2()
+	<-errs
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("shared lookup not canceled after all callers left")
+	}
+}
+
+func TestFlightECSName(t *testing.T) {
+	ctx := context.Background()
+	e1, _ := ParseECS("192.0.2.0/24")
+	e2, _ := ParseECS("198.51.100.0/24")
+	names := map[string]bool{}
+	for _, c := range []context.Context{ctx, WithECS(ctx, e1), WithECS(ctx, e2), WithECS(ctx, &ECS{Auto: true})} {
+		names[ecsname(c, "ecs.terasu.test")] = true
+	}
+	if len(names) != 4 || !names["ecs.terasu.test"] {
+		t.Fatal("unexpected", names)
+	}
+	HostCache.Set(ecsname(WithECS(ctx, e1), "ecs.terasu.test"), []string{"192.0.2.1"})
+	HostCache.Delete("ecs.terasu.test")
+	if HostCache.Get(ecsname(WithECS(ctx, e1), "ecs.terasu.test")) != nil {
+		t.Fatal("subnet entry not deleted")
+	}
+}
@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const dnsJSONMIME = "application/dns-json"
+
+// jsonTypes are the record type names accepted by the json API
+var jsonTypes = map[string]dnsmessage.Type{
+	"A": dnsmessage.TypeA, "NS": dnsmessage.TypeNS, "CNAME": dnsmessage.TypeCNAME,
+	"SOA": dnsmessage.TypeSOA, "PTR": dnsmessage.TypePTR, "MX": dnsmessage.TypeMX,
+	"TXT": dnsmessage.TypeTXT, "AAAA": dnsmessage.TypeAAAA, "SRV": dnsmessage.TypeSRV,
+	"ANY": dnsmessage.TypeALL,
+}
+
+// DoHHandler serves DNS over HTTPS through Server. It accepts RFC 8484
+// GET ?dns= and POST of application/dns-message, and the json API of
+// GET ?name=&type= answered in the same shape as the DoH client expects.
+type DoHHandler struct {
+	// Server answers the queries, a shared zero Server if nil
+	Server *Server
+}
+
+var (
+	// dohserver is the Server of the handlers without one,
+	// its cache is purged along with HostCache for good
+	dohserver     *Server
+	dohserveronce sync.Once
+)
+
+func (h *DoHHandler) server() *Server {
+	if h.Server != nil {
+		return h.Server
+	}
+	dohserveronce.Do(func() {
+		dohserver = &Server{}
+		HostCache.link(&dohserver.cache)
+	})
+	return dohserver
+}
+
+func (h *DoHHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var q []byte
+	var err error
+	isjson := false
+	switch r.Method {
+	case http.MethodGet:
+		if v := r.URL.Query().Get("dns"); v != "" {
+			q, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+		} else {
+			isjson = true
+			q, err = jsonquery(r)
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("content-type"); ct != dnsMessageMIME {
+			http.Error(w, "unsupported content type "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		q, err = io.ReadAll(io.LimitReader(r.Body, 65536))
+		if err == nil && len(q) > 65535 {
+			http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(q) < 12 {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	resp := h.server().handle(q)
+	if resp == nil {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	if t, ok := cachettl(resp); ok {
+		w.Header().Set("cache-control", "max-age="+strconv.Itoa(int(t)))
+	}
+	if !isjson {
+		w.Header().Set("content-type", dnsMessageMIME)
+		_, _ = w.Write(resp)
+		return
+	}
+	jr, err := parseresponse(resp)
+	if err != nil && jr.Status == 0 { // not an rcode
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("content-type", dnsJSONMIME)
+	_ = json.NewEncoder(w).Encode(&jr)
+}
+
+// jsonquery builds the wire query of the json API parameters
+func jsonquery(r *http.Request) ([]byte, error) {
+	v := r.URL.Query()
+	name := v.Get("name")
+	if name == "" {
+		return nil, ErrUnsupportedQuery
+	}
+	typ := dnsmessage.TypeA
+	if t := v.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			typ = dnsmessage.Type(n)
+		} else if jt, ok := jsonTypes[strings.ToUpper(t)]; ok {
+			typ = jt
+		} else {
+			return nil, ErrUnsupportedQuery
+		}
+	}
+	q, err := newquery(0, name, typ)
+	if err != nil {
+		return nil, err
+	}
+	if cd := v.Get("cd"); cd == "1" || cd == "true" {
+		q[3] |= 0x10 // CD bit
+	}
+	if do := v.Get("do"); do == "1" || do == "true" {
+		// the DO bit in the ttl of the empty OPT record at the end
+		q[len(q)-4] |= 0x80
+	}
+	if v := v.Get("edns_client_subnet"); v != "" {
+		e, err := ParseECS(v)
+		if err != nil || e.Auto {
+			return nil, ErrInvalidECS
+		}
+		q, err = withecs(q, e.Prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
@@ -0,0 +1,85 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDoHHandler(t *testing.T) {
+	srv := &Server{}
+	startserver(t, srv)
+	ts := httptest.NewServer(&DoHHandler{Server: srv})
+	defer ts.Close()
+
+	q, err := newquery(0, "doh.terasu.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(resp *http.Response) {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("content-type") != dnsMessageMIME {
+			t.Fatal("unexpected", resp.Status, resp.Header)
+		}
+		msg, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs := answeraddrs(msg); len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+			t.Fatal("unexpected", addrs)
+		}
+	}
+	resp, err := http.Post(ts.URL, dnsMessageMIME, bytes.NewReader(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(resp)
+	resp, err = http.Get(ts.URL + "?dns=" + base64.RawURLEncoding.EncodeToString(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(resp)
+
+	resp, err = http.Get(ts.URL + "?name=json.terasu.test&type=TXT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var jr dohjsonresponse
+	if err = json.NewDecoder(resp.Body).Decode(&jr); err != nil {
+		t.Fatal(err)
+	}
+	if jr.Status != 0 || len(jr.Answer) != 1 || jr.Answer[0].Type != recordType(dnsmessage.TypeTXT) ||
+		jr.Answer[0].Data[:2] != `"a` {
+		t.Fatal("unexpected", jr)
+	}
+
+	resp, err = http.Post(ts.URL, "text/plain", bytes.NewReader(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatal("unexpected", resp.Status)
+	}
+}
+
+func TestDoHHandlerDefaultServer(t *testing.T) {
+	h := &DoHHandler{}
+	srv := h.server()
+	if srv != h.server() || srv != (&DoHHandler{}).server() {
+		t.Fatal("default server not reused")
+	}
+	srv.cache.store("default.terasu.test TypeA ClassINET", &wireentry{}, time.Minute)
+	HostCache.Delete("default.terasu.test")
+	if srv.cache.load("default.terasu.test TypeA ClassINET") != nil {
+		t.Fatal("default server cache not purged with HostCache")
+	}
+}
@@ -0,0 +1,210 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HealthConfig tunes how servers of a DNSList are scored and disabled
+type HealthConfig struct {
+	// Alpha is the EWMA weight of a new latency sample, default 0.3
+	Alpha float64
+	// UnknownLatency is the latency assumed for servers without samples, default 500ms
+	UnknownLatency time.Duration
+	// FailurePenalty is added to the score in proportion to the failure rate, default 2s
+	FailurePenalty time.Duration
+	// MinBackoff disables a server after its first failure, default 10s
+	MinBackoff time.Duration
+	// MaxBackoff caps the doubling backoff of consecutive failures, default 1h
+	MaxBackoff time.Duration
+	// ProbeInterval probes all servers in background, 0 disables probing
+	ProbeInterval time.Duration
+	// ProbeHost is looked up by DoH probes, default dns.google
+	ProbeHost string
+}
+
+func (c HealthConfig) withdefaults() HealthConfig {
+	if c.Alpha <= 0 || c.Alpha > 1 {
+		c.Alpha = 0.3
+	}
+	if c.UnknownLatency <= 0 {
+		c.UnknownLatency = time.Millisecond * 500
+	}
+	if c.FailurePenalty <= 0 {
+		c.FailurePenalty = time.Second * 2
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Second * 10
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = time.Hour
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = c.MinBackoff
+	}
+	if c.ProbeHost == "" {
+		c.ProbeHost = "dns.google"
+	}
+	return c
+}
+
+// SetHealth replaces the health config and restarts background probing
+func (ds *DNSList) SetHealth(c HealthConfig) {
+	// the prober follows the config under the same lock
+	ds.update(func(s *serverset) {
+		s.health = c
+		if ds.probing != nil {
+			close(ds.probing)
+			ds.probing = nil
+		}
+		if c.ProbeInterval > 0 {
+			ds.probing = make(chan struct{})
+			go ds.probeloop(c.ProbeInterval, ds.probing)
+		}
+	})
+}
+
+func (ds *dnsstat) succeeded(c *HealthConfig, latency time.Duration) {
+	ds.succ.Add(1)
+	ds.fails.Store(0)
+	ds.until.Store(0)
+	for {
+		old := ds.latency.Load()
+		n := int64(latency)
+		if old != 0 {
+			n = int64(c.Alpha*float64(latency) + (1-c.Alpha)*float64(old))
+		}
+		if ds.latency.CompareAndSwap(old, n) {
+			return
+		}
+	}
+}
+
+// failed backs the server off if err is caused by itself
+func (ds *dnsstat) failed(c *HealthConfig, err error) {
+	if !shoulddisable(err) {
+		return
+	}
+	ds.fail.Add(1)
+	fails := ds.fails.Load()
+	backoff := c.MinBackoff << fails
+	if backoff <= 0 || backoff > c.MaxBackoff { // overflowed or capped
+		backoff = c.MaxBackoff
+	} else {
+		ds.fails.CompareAndSwap(fails, fails+1)
+	}
+	now := time.Now()
+	ds.failedat.Store(now.UnixNano())
+	until := now.Add(backoff).UnixNano()
+	ds.until.Store(until)
+	if errors.Is(err, ErrPoisoned) {
+		ds.poisoned.Store(until)
+	}
+	logrus.Debugln("[terasu.dns] == disable", ds.addr, "for", backoff, "err:", err)
+}
+
+// score is the expected cost of using this server, lower is better
+func (ds *dnsstat) score(c *HealthConfig) time.Duration {
+	succ, fail := ds.succ.Load(), ds.fail.Load()
+	s := time.Duration(ds.latency.Load())
+	if succ == 0 {
+		s = c.UnknownLatency
+	}
+	if total := succ + fail; total > 0 {
+		s += time.Duration(float64(c.FailurePenalty) * float64(fail) / float64(total))
+	}
+	return s
+}
+
+// ranked returns enabled servers ordered by score, or all of
+// them by their least recent failure if none is enabled
+func (s *serverset) ranked() []racer {
+	c := s.health.withdefaults()
+	rs := make([]racer, 0, 16)
+	scores := make(map[*dnsstat]time.Duration, 16)
+	_ = s.rangeHosts(func(host string, addrs []*dnsstat) error {
+		for _, addr := range addrs {
+			if !addr.enabled() {
+				continue
+			}
+			rs = append(rs, racer{host: host, addr: addr})
+			scores[addr] = addr.score(&c)
+		}
+		return nil
+	})
+	// stable to keep the order of hostseq among equal scores
+	sort.SliceStable(rs, func(i, j int) bool {
+		return scores[rs[i].addr] < scores[rs[j].addr]
+	})
+	if len(rs) > 0 {
+		return rs
+	}
+	// better a server that may have recovered than none
+	_ = s.rangeHosts(func(host string, addrs []*dnsstat) error {
+		for _, addr := range addrs {
+			rs = append(rs, racer{host: host, addr: addr})
+		}
+		return nil
+	})
+	sort.SliceStable(rs, func(i, j int) bool {
+		return rs[i].addr.failedat.Load() < rs[j].addr.failedat.Load()
+	})
+	return rs
+}
+
+func (ds *DNSList) probeloop(interval time.Duration, stop chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			ds.probe()
+		}
+	}
+}
+
+// probe all servers including the disabled ones
+func (ds *DNSList) probe() {
+	s := ds.load()
+	c := s.health.withdefaults()
+	rs := make([]racer, 0, 16)
+	_ = s.rangeHosts(func(host string, addrs []*dnsstat) error {
+		for _, addr := range addrs {
+			rs = append(rs, racer{host: host, addr: addr})
+		}
+		return nil
+	})
+	wg := sync.WaitGroup{}
+	for _, r := range rs {
+		wg.Add(1)
+		go func(r racer) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(withbootstrap(context.Background(), ds), dnsDialer.Timeout*2)
+			defer cancel()
+			start := time.Now()
+			err := r.probe(ctx, c.ProbeHost, s)
+			if err != nil {
+				r.addr.failed(&c, err)
+				return
+			}
+			r.addr.succeeded(&c, time.Since(start))
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (r *racer) probe(ctx context.Context, probehost string, s *serverset) error {
+	if r.addr.ishttps() {
+		_, err := lookupdohwithtype(ctx, r.addr.up, probehost, recordTypeA)
+		return err
+	}
+	_, err := r.lookup(ctx, probehost, s)
+	return err
+}
@@ -0,0 +1,103 @@
+package dns
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthBackoff(t *testing.T) {
+	c := HealthConfig{MinBackoff: time.Second, MaxBackoff: time.Second * 5}.withdefaults()
+	ds := &dnsstat{addr: "192.0.2.1:853"}
+	errbad := errors.New("bad server")
+	expected := []time.Duration{1, 2, 4, 5, 5}
+	for _, e := range expected {
+		ds.failed(&c, errbad)
+		backoff := time.Until(ds.backoffuntil())
+		if backoff > e*time.Second || backoff < e*time.Second-time.Millisecond*100 {
+			t.Fatal("expected backoff", e*time.Second, "but got", backoff)
+		}
+	}
+	if ds.enabled() {
+		t.Fatal("unexpected enabled")
+	}
+	ds.succeeded(&c, time.Millisecond*10)
+	if !ds.enabled() || ds.fails.Load() != 0 {
+		t.Fatal("unexpected disabled")
+	}
+}
+
+func TestHealthRanked(t *testing.T) {
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{
+		"slow.test": {"192.0.2.1:853"},
+		"fast.test": {"192.0.2.2:853"},
+		"dead.test": {"192.0.2.3:853"},
+	}})
+	s := ds.load()
+	c := s.health.withdefaults()
+	s.m["slow.test"][0].succeeded(&c, time.Millisecond*300)
+	s.m["fast.test"][0].succeeded(&c, time.Millisecond*30)
+	s.m["dead.test"][0].failed(&c, errors.New("bad server"))
+	rs := s.ranked()
+	if len(rs) != 2 {
+		t.Fatal("unexpected ranked", rs)
+	}
+	if rs[0].host != "fast.test" || rs[1].host != "slow.test" {
+		t.Fatal("unexpected order", rs[0].host, rs[1].host)
+	}
+	// all disabled, the least recent failure first
+	s.m["fast.test"][0].failed(&c, errors.New("bad server"))
+	s.m["slow.test"][0].failed(&c, errors.New("bad server"))
+	for i, host := range []string{"dead.test", "fast.test", "slow.test"} {
+		s.m[host][0].failedat.Store(int64(i + 1))
+	}
+	rs = s.ranked()
+	if len(rs) != 3 || rs[0].host != "dead.test" || rs[1].host != "fast.test" || rs[2].host != "slow.test" {
+		t.Fatal("unexpected fallback", rs)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	ds := DNSList{}
+	defer ds.Close()
+	ds.SetHealth(HealthConfig{ProbeInterval: time.Hour})
+	ds.Add(&DNSConfig{Servers: map[string][]string{
+		"snap.test": {"192.0.2.1:853", "https://192.0.2.1/dns-query"},
+	}})
+	ds.Add(&DNSConfig{Servers: map[string][]string{
+		"snap.test": {"192.0.2.1:853", "192.0.2.2:853"},
+	}})
+	c := ds.load().health.withdefaults()
+	ds.load().m["snap.test"][0].failed(&c, errors.New("bad server"))
+	sts := ds.Snapshot()
+	if len(sts) != 3 {
+		t.Fatal("unexpected snapshot", sts)
+	}
+	if sts[0].Enabled || sts[0].Failure != 1 || sts[0].BackoffUntil.IsZero() {
+		t.Fatal("unexpected status", sts[0])
+	}
+	if !sts[1].DoH || !sts[1].Enabled || sts[2].Addr != "192.0.2.2:853" {
+		t.Fatal("unexpected status", sts[1:])
+	}
+}
+
+func TestSetHealthConcurrent(t *testing.T) {
+	ds := DNSList{}
+	defer ds.Close()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ds.SetHealth(HealthConfig{ProbeInterval: time.Duration(i%2) * time.Hour})
+		}(i)
+	}
+	wg.Wait()
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if (ds.load().health.ProbeInterval > 0) != (ds.probing != nil) {
+		t.Fatal("prober out of step with config", ds.load().health.ProbeInterval, ds.probing)
+	}
+}
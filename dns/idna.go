@@ -0,0 +1,24 @@
+package dns
+
+import "github.com/fumiama/terasu"
+
+// ErrInvalidHostname is matched by errors.Is on any *IDNAError
+var ErrInvalidHostname = terasu.ErrInvalidHostname
+
+// IDNAError reports the label of Name rejected by the UTS #46 lookup profile
+type IDNAError = terasu.IDNAError
+
+func isascii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// ToASCII normalises host by the UTS #46 lookup profile into lowercase
+// A-labels without the trailing dot, an IP literal is returned as is
+func ToASCII(host string) (string, error) {
+	return terasu.ToASCII(host)
+}
@@ -0,0 +1,90 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestToASCII(t *testing.T) {
+	for host, want := range map[string]string{
+		"Bücher.Example.":   "xn--bcher-kva.example",
+		"例え。テスト":            "xn--r8jz45g.xn--zckzah",
+		"XN--BCHER-KVA.com": "xn--bcher-kva.com",
+		"WWW.Example.COM":   "www.example.com",
+		"192.0.2.1":         "192.0.2.1",
+		"fe80::1%Eth0":      "fe80::1%Eth0",
+	} {
+		got, err := ToASCII(host)
+		if err != nil || got != want {
+			t.Fatal(host, "unexpected", got, err)
+		}
+	}
+	for _, host := range []string{"xn--a.example", "a\u200db.example", strings.Repeat("a", 60) + "ü.example"} {
+		_, err := ToASCII(host)
+		var ierr *IDNAError
+		if !errors.Is(err, ErrInvalidHostname) || !errors.As(err, &ierr) || ierr.Label == "" {
+			t.Fatal(host, "unexpected", err)
+		}
+	}
+}
+
+func TestIDNALookup(t *testing.T) {
+	o := Overrides{}
+	if err := o.Set("bücher.terasu.test", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set("*.müller.terasu.test", "192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Alias("xn--a.terasu.test", "bücher.terasu.test"); !errors.Is(err, ErrInvalidHostname) {
+		t.Fatal("unexpected", err)
+	}
+	for name, want := range map[string]string{
+		"BÜCHER.terasu.test":            "192.0.2.1",
+		"xn--bcher-kva.terasu.test":     "192.0.2.1",
+		"www.xn--mller-kva.terasu.test": "192.0.2.2",
+	} {
+		ov, ok := o.Lookup(name)
+		if !ok || ov.Addrs[0] != want {
+			t.Fatal(name, "unexpected", ov, ok)
+		}
+	}
+
+	if err := HostOverrides.Set("bücher.terasu.test", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	defer HostOverrides.Delete("xn--bcher-kva.terasu.test")
+	addrs, err := LookupHost(context.Background(), "Bücher.terasu.test")
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("unexpected", addrs, err)
+	}
+	if _, err = LookupHost(context.Background(), "xn--a.terasu.test"); !errors.Is(err, ErrInvalidHostname) {
+		t.Fatal("unexpected", err)
+	}
+
+	q, err := newquery(0, "bücher.terasu.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err = m.Unpack(q); err != nil || m.Questions[0].Name.String() != "xn--bcher-kva.terasu.test." {
+		t.Fatal("unexpected", m.Questions, err)
+	}
+
+	up, err := ParseUpstream("https://bücher.terasu.test:8443/dns-query?sni=例え.テスト")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.URL != "https://xn--bcher-kva.terasu.test:8443/dns-query" || up.SNI != "xn--r8jz45g.xn--zckzah" {
+		t.Fatal("unexpected", up)
+	}
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"bücher.terasu.test": {"192.0.2.53"}}})
+	if addrs := ds.Config().Servers["xn--bcher-kva.terasu.test"]; len(addrs) != 1 {
+		t.Fatal("unexpected", ds.Config())
+	}
+}
@@ -0,0 +1,365 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxReferrals limits the referrals followed for one name
+	maxReferrals = 16
+	// maxIterDepth limits the nested resolution of name servers without glue
+	maxIterDepth = 4
+	// maxDelegationTTL caps the time a delegation is cached
+	maxDelegationTTL = time.Hour * 24
+)
+
+var (
+	// ErrReferralLimit is reported when a name takes too many referrals or aliases
+	ErrReferralLimit = errors.New("too many referrals")
+	// ErrLameDelegation is reported when no server of a zone answers properly
+	ErrLameDelegation = errors.New("lame delegation")
+)
+
+// RootHints are the addresses of the root servers of
+// https://www.internic.net/domain/named.root, used by
+// iterative upstreams without their own hints
+var RootHints = []string{
+	"198.41.0.4", "2001:503:ba3e::2:30", // a.root-servers.net
+	"170.247.170.2", "2801:1b8:10::b", // b.root-servers.net
+	"192.33.4.12", "2001:500:2::c", // c.root-servers.net
+	"199.7.91.13", "2001:500:2d::d", // d.root-servers.net
+	"192.203.230.10", "2001:500:a8::e", // e.root-servers.net
+	"192.5.5.241", "2001:500:2f::f", // f.root-servers.net
+	"192.112.36.4", "2001:500:12::d0d", // g.root-servers.net
+	"198.97.190.53", "2001:500:1::53", // h.root-servers.net
+	"192.36.148.17", "2001:7fe::53", // i.root-servers.net
+	"192.58.128.30", "2001:503:c27::2:30", // j.root-servers.net
+	"193.0.14.129", "2001:7fd::1", // k.root-servers.net
+	"199.7.83.42", "2001:500:9f::42", // l.root-servers.net
+	"202.12.27.33", "2001:dc3::35", // m.root-servers.net
+}
+
+// dialauth connects to an authoritative server
+var dialauth = func(ctx context.Context, addr string) (net.Conn, error) {
+	return dnsDialer.DialContext(ctx, "tcp", addr)
+}
+
+// iterator resolves queries by itself from the root servers,
+// following the referrals over tcp and caching the delegations
+type iterator struct {
+	// delegations are the server addresses of the zones met
+	delegations Cache
+}
+
+// reachable drops IPv6 addrs if IPv6 is not available, unless none is left
+func reachable(addrs []string) []string {
+	if ipv6available() {
+		return addrs
+	}
+	lst := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		if ip, err := netip.ParseAddr(a); err == nil && ip.Is4() {
+			lst = append(lst, a)
+		}
+	}
+	if len(lst) == 0 {
+		return addrs
+	}
+	return lst
+}
+
+// closest is the deepest cached zone of name and its servers
+func (it *iterator) closest(name string, hints []string) (string, []string) {
+	for zone := name; zone != "."; zone = parentname(zone) {
+		if addrs := it.delegations.Get(zone); len(addrs) > 0 {
+			return zone, addrs
+		}
+	}
+	if len(hints) == 0 {
+		hints = RootHints
+	}
+	return ".", hints
+}
+
+// exchange answers q iteratively, following the CNAME chain
+func (it *iterator) exchange(ctx context.Context, hints []string, q []byte) ([]byte, error) {
+	qi, err := parsequery(q)
+	if err != nil {
+		return nil, err
+	}
+	typ := qi.question.Type
+	name := canonname(qi.question.Name.String())
+	var answers []dnsmessage.Resource
+	for hops := 0; ; {
+		m, zone, err := it.resolve(ctx, hints, name, typ, qi.dnssecok(), 0)
+		if err != nil {
+			return nil, err
+		}
+		// follow the chain inside m as far as zone is authoritative,
+		// any target out of it is resolved afresh
+		cur := name
+		for issubdomain(cur, zone) {
+			next := ""
+			for _, r := range m.Answers {
+				if canonname(r.Header.Name.String()) != cur {
+					continue
+				}
+				answers = append(answers, r)
+				if c, ok := r.Body.(*dnsmessage.CNAMEResource); ok && typ != dnsmessage.TypeCNAME {
+					next = canonname(c.CNAME.String())
+				}
+			}
+			if next == "" || hasanswer(m.Answers, cur, typ) {
+				break
+			}
+			if hops++; hops > maxAliasDepth {
+				return nil, ErrReferralLimit
+			}
+			cur = next
+		}
+		if cur != name && (!issubdomain(cur, zone) || !hasowner(m.Answers, cur)) {
+			name = cur
+			continue
+		}
+		var authorities []dnsmessage.Resource
+		if !hasanswer(answers, cur, typ) {
+			// the soa and the proof of denial
+			authorities = m.Authorities
+		}
+		return qi.replyiterative(m.RCode, answers, authorities)
+	}
+}
+
+// hasowner tells whether rs holds any record of name
+func hasowner(rs []dnsmessage.Resource, name string) bool {
+	for _, r := range rs {
+		if canonname(r.Header.Name.String()) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasanswer tells whether rs holds typ of name
+func hasanswer(rs []dnsmessage.Resource, name string, typ dnsmessage.Type) bool {
+	for _, r := range rs {
+		if r.Header.Type == typ && canonname(r.Header.Name.String()) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// replyiterative builds a response of qi with its authorities, keeping the DO bit
+func (qi *queryinfo) replyiterative(rcode dnsmessage.RCode, answers, authorities []dnsmessage.Resource) ([]byte, error) {
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID: qi.header.ID, Response: true, OpCode: qi.header.OpCode,
+			RecursionDesired: qi.header.RecursionDesired, RecursionAvailable: true,
+			CheckingDisabled: qi.header.CheckingDisabled, RCode: rcode,
+		},
+		Questions:   []dnsmessage.Question{qi.question},
+		Answers:     answers,
+		Authorities: authorities,
+	}
+	if qi.opt != nil {
+		var h dnsmessage.ResourceHeader
+		err := h.SetEDNS0(ednsPayloadLen, rcode, qi.dnssecok())
+		if err != nil {
+			return nil, err
+		}
+		m.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	}
+	return m.Pack()
+}
+
+// resolve name in typ from the closest known zone down,
+// returning the answer and the zone of the server that answered
+func (it *iterator) resolve(
+	ctx context.Context, hints []string, name string, typ dnsmessage.Type, do bool, depth int,
+) (*dnsmessage.Message, string, error) {
+	zone, servers := it.closest(name, hints)
+	for i := 0; i < maxReferrals; i++ {
+		m, err := ask(ctx, reachable(servers), name, typ, do)
+		if err != nil {
+			return nil, "", fmt.Errorf("%w of %s: %v", ErrLameDelegation, zone, err)
+		}
+		child, nsnames, ttl := referral(m, zone, name)
+		if child == "" {
+			return m, zone, nil
+		}
+		addrs := glue(m, zone, nsnames)
+		if len(addrs) == 0 {
+			if depth >= maxIterDepth {
+				return nil, "", ErrReferralLimit
+			}
+			addrs = it.resolvens(ctx, hints, nsnames, depth+1)
+		}
+		if len(addrs) == 0 {
+			return nil, "", fmt.Errorf("%w of %s: no address of its servers", ErrLameDelegation, child)
+		}
+		logrus.Debugln("[terasu.dns] -- iterative", name, "referred to", child, addrs)
+		it.delegations.setttl(child, addrs, ttl)
+		zone, servers = child, addrs
+	}
+	return nil, "", ErrReferralLimit
+}
+
+// referral finds the child zone of zone toward name that m delegates to,
+// an empty child means m is an answer
+func referral(m *dnsmessage.Message, zone, name string) (child string, nsnames []string, ttl time.Duration) {
+	if m.RCode != dnsmessage.RCodeSuccess || len(m.Answers) > 0 {
+		return
+	}
+	ttl = maxDelegationTTL
+	for _, r := range m.Authorities {
+		ns, ok := r.Body.(*dnsmessage.NSResource)
+		if !ok {
+			continue
+		}
+		owner := canonname(r.Header.Name.String())
+		// the child must be closer to name, never a sibling or an ancestor
+		if owner == zone || !issubdomain(owner, zone) || !issubdomain(name, owner) {
+			continue
+		}
+		if child != "" && owner != child {
+			continue
+		}
+		child = owner
+		nsnames = append(nsnames, canonname(ns.NS.String()))
+		if t := time.Duration(r.Header.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return
+}
+
+// glue are the addresses of nsnames in the additionals of m,
+// only trusted when inside the zone of the referring servers
+func glue(m *dnsmessage.Message, zone string, nsnames []string) (addrs []string) {
+	for _, r := range m.Additionals {
+		owner := canonname(r.Header.Name.String())
+		if !issubdomain(owner, zone) || !hasfallback(nsnames, owner) {
+			continue
+		}
+		switch b := r.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(b.A).String())
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(b.AAAA).String())
+		}
+	}
+	return
+}
+
+// resolvens looks up the addresses of the first resolvable name server
+func (it *iterator) resolvens(ctx context.Context, hints []string, nsnames []string, depth int) []string {
+	types := []dnsmessage.Type{dnsmessage.TypeA}
+	if ipv6available() {
+		types = append(types, dnsmessage.TypeAAAA)
+	}
+	for _, ns := range nsnames {
+		var addrs []string
+		for _, typ := range types {
+			m, _, err := it.resolve(ctx, hints, ns, typ, false, depth)
+			if err != nil {
+				logrus.Debugln("[terasu.dns] -- iterative ns", ns, typ, "err:", err)
+				continue
+			}
+			for _, r := range m.Answers {
+				if canonname(r.Header.Name.String()) != ns {
+					continue
+				}
+				switch b := r.Body.(type) {
+				case *dnsmessage.AResource:
+					addrs = append(addrs, netip.AddrFrom4(b.A).String())
+				case *dnsmessage.AAAAResource:
+					addrs = append(addrs, netip.AddrFrom16(b.AAAA).String())
+				}
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs
+		}
+	}
+	return nil
+}
+
+// ask the servers one by one from a random one
+// until any of them responds to name in typ
+func ask(ctx context.Context, servers []string, name string, typ dnsmessage.Type, do bool) (*dnsmessage.Message, error) {
+	q, err := newquery(uint16(rand.Intn(0x10000)), name, typ)
+	if err != nil {
+		return nil, err
+	}
+	q[2] &^= 0x01 // RD bit, authoritative servers do not recurse
+	if do {
+		q, err = withdnssecok(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ErrNoDNSAvailable
+	start := rand.Intn(len(servers))
+	for i := range servers {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		addr := net.JoinHostPort(strings.Trim(servers[(start+i)%len(servers)], "[]"), "53")
+		var m *dnsmessage.Message
+		m, err = askone(ctx, addr, q, name, typ)
+		if err != nil {
+			logrus.Debugln("[terasu.dns] -- iterative", addr, name, typ, "err:", err)
+			continue
+		}
+		return m, nil
+	}
+	return nil, err
+}
+
+// askone exchanges q of name in typ with the server at addr over tcp
+func askone(ctx context.Context, addr string, q []byte, name string, typ dnsmessage.Type) (*dnsmessage.Message, error) {
+	ctx, cancel := dialctx(ctx, &dnsDialer)
+	defer cancel()
+	conn, err := dialauth(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	_, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(q))), q...))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := readstreammsg(conn)
+	if err != nil {
+		return nil, err
+	}
+	var m dnsmessage.Message
+	err = m.Unpack(resp)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Response || m.ID != binary.BigEndian.Uint16(q) || len(m.Questions) != 1 ||
+		m.Questions[0].Type != typ || canonname(m.Questions[0].Name.String()) != name {
+		return nil, ErrInvalidResponse
+	}
+	switch m.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+		return &m, nil
+	}
+	return nil, errors.New("rcode " + m.RCode.String())
+}
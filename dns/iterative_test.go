@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func authrr(name string, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   body,
+	}
+}
+
+func authA(name, a string) dnsmessage.Resource {
+	return authrr(name, &dnsmessage.AResource{A: netip.MustParseAddr(a).As4()})
+}
+
+func authNS(zone, ns string) dnsmessage.Resource {
+	return authrr(zone, &dnsmessage.NSResource{NS: dnsmessage.MustNewName(ns)})
+}
+
+func authCNAME(name, target string) dnsmessage.Resource {
+	return authrr(name, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)})
+}
+
+func authSOA(zone string) dnsmessage.Resource {
+	return authrr(zone, &dnsmessage.SOAResource{
+		NS: dnsmessage.MustNewName("ns.terasu.test."), MBox: dnsmessage.MustNewName("hostmaster.terasu.test."),
+		Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 60,
+	})
+}
+
+// startauth serves the authoritative answers of handle over tcp
+func startauth(t *testing.T, queries *atomic.Int32, handle func(q dnsmessage.Question) dnsmessage.Message) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				q, err := readstreammsg(conn)
+				if err != nil {
+					return
+				}
+				var qm dnsmessage.Message
+				if qm.Unpack(q) != nil || len(qm.Questions) != 1 || qm.RecursionDesired {
+					return
+				}
+				queries.Add(1)
+				m := handle(qm.Questions[0])
+				m.ID, m.Response, m.Questions = qm.ID, true, qm.Questions
+				resp, err := m.Pack()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func TestIterative(t *testing.T) {
+	var rootq, testq, otherq, subq atomic.Int32
+	// . delegates test. with glue and other. to a glueless server in test.
+	root := startauth(t, &rootq, func(q dnsmessage.Question) dnsmessage.Message {
+		name := q.Name.String()
+		switch {
+		case strings.HasSuffix(name, ".test."):
+			return dnsmessage.Message{
+				Authorities: []dnsmessage.Resource{authNS("test.", "ns1.test.")},
+				Additionals: []dnsmessage.Resource{authA("ns1.test.", "192.0.2.2")},
+			}
+		case strings.HasSuffix(name, ".other."):
+			return dnsmessage.Message{Authorities: []dnsmessage.Resource{authNS("other.", "ns.glueless.test.")}}
+		}
+		return dnsmessage.Message{
+			Header:      dnsmessage.Header{Authoritative: true, RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{authSOA(".")},
+		}
+	})
+	// test. delegates sub.test. to ns.other. with a glue it must not trust
+	test := startauth(t, &testq, func(q dnsmessage.Question) dnsmessage.Message {
+		aa := dnsmessage.Header{Authoritative: true}
+		switch q.Name.String() {
+		case "www.test.":
+			return dnsmessage.Message{Header: aa, Answers: []dnsmessage.Resource{authA("www.test.", "192.0.2.80")}}
+		case "chain.test.":
+			return dnsmessage.Message{Header: aa, Answers: []dnsmessage.Resource{
+				authCNAME("chain.test.", "www.test."), authA("www.test.", "192.0.2.80"),
+			}}
+		case "evil.test.":
+			// the forged target is out of the bailiwick of test.
+			return dnsmessage.Message{Header: aa, Answers: []dnsmessage.Resource{
+				authCNAME("evil.test.", "www.other."), authA("www.other.", "203.0.113.66"),
+			}}
+		case "alias.test.":
+			return dnsmessage.Message{Header: aa, Answers: []dnsmessage.Resource{authCNAME("alias.test.", "www.other.")}}
+		case "ns.glueless.test.":
+			return dnsmessage.Message{Header: aa, Answers: []dnsmessage.Resource{authA("ns.glueless.test.", "192.0.2.3")}}
+		case "www.sub.test.":
+			return dnsmessage.Message{
+				Authorities: []dnsmessage.Resource{authNS("sub.test.", "ns.other.")},
+				Additionals: []dnsmessage.Resource{authA("ns.other.", "192.0.2.99")},
+			}
+		}
+		aa.RCode = dnsmessage.RCodeNameError
+		return dnsmessage.Message{Header: aa, Authorities: []dnsmessage.Resource{authSOA("test.")}}
+	})
+	other := startauth(t, &otherq, func(q dnsmessage.Question) dnsmessage.Message {
+		aa := dnsmessage.Header{Authoritative: true}
+		switch q.Name.String() {
+		case "www.other.":
+			return dnsmessage.Message{Header: aa, Answers: []dnsmessage.Resource{authA("www.other.", "192.0.2.81")}}
+		case "ns.other.":
+			return dnsmessage.Message{Header: aa, Answers: []dnsmessage.Resource{authA("ns.other.", "192.0.2.4")}}
+		}
+		return dnsmessage.Message{Header: aa, Authorities: []dnsmessage.Resource{authSOA("other.")}}
+	})
+	sub := startauth(t, &subq, func(q dnsmessage.Question) dnsmessage.Message {
+		return dnsmessage.Message{Header: dnsmessage.Header{Authoritative: true}, Answers: []dnsmessage.Resource{authA("www.sub.test.", "192.0.2.82")}}
+	})
+	servers := map[string]string{
+		"192.0.2.1:53": root, "192.0.2.2:53": test, "192.0.2.3:53": other, "192.0.2.4:53": sub,
+	}
+	defer func(f func(context.Context, string) (net.Conn, error)) { dialauth = f }(dialauth)
+	dialauth = func(ctx context.Context, addr string) (net.Conn, error) {
+		a, ok := servers[addr]
+		if !ok {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: net.UnknownNetworkError(addr)}
+		}
+		return dnsDialer.DialContext(ctx, "tcp", a)
+	}
+
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"iterative": {"iterative://root?hints=192.0.2.1"}}})
+	up := ds.load().m["iterative"][0].up
+	if up.Scheme != SchemeIterative || len(up.Hints) != 1 || up.String() != "iterative://root?hints=192.0.2.1" {
+		t.Fatal("unexpected", up)
+	}
+	lookup := func(name string) (dnsmessage.RCode, []string) {
+		q, err := newquery(0x1234, name, dnsmessage.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ds.exchange(context.Background(), q)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		var m dnsmessage.Message
+		if err = m.Unpack(resp); err != nil || m.ID != 0x1234 || !m.RecursionAvailable {
+			t.Fatal(name, "unexpected", m.Header, err)
+		}
+		var answers []string
+		for _, r := range m.Answers {
+			switch b := r.Body.(type) {
+			case *dnsmessage.AResource:
+				answers = append(answers, netip.AddrFrom4(b.A).String())
+			case *dnsmessage.CNAMEResource:
+				answers = append(answers, b.CNAME.String())
+			}
+		}
+		return m.RCode, answers
+	}
+	for name, want := range map[string]string{
+		"www.test":      "192.0.2.80",
+		"chain.test":    "www.test. 192.0.2.80",
+		"alias.test":    "www.other. 192.0.2.81",
+		"evil.test":     "www.other. 192.0.2.81",
+		"www.sub.test":  "192.0.2.82",
+		"WWW.Other.":    "192.0.2.81",
+		"nx.test":       "NXDOMAIN",
+		"nowhere.arpa.": "NXDOMAIN",
+	} {
+		rcode, answers := lookup(name)
+		got := strings.Join(answers, " ")
+		if rcode == dnsmessage.RCodeNameError {
+			got = "NXDOMAIN"
+		}
+		if got != want {
+			t.Fatal(name, "unexpected", rcode, answers)
+		}
+	}
+	// the delegations of test. and other. are cached
+	n := rootq.Load()
+	if rcode, answers := lookup("www.test"); rcode != dnsmessage.RCodeSuccess || len(answers) != 1 || rootq.Load() != n {
+		t.Fatal("unexpected", rcode, answers, rootq.Load(), n)
+	}
+	if st := ds.load().m["iterative"][0].iter.delegations.Stats(); st.Len != 3 {
+		t.Fatal("unexpected delegations", ds.load().m["iterative"][0].iter.delegations.Entries())
+	}
+
+	// lame root
+	lame := DNSList{}
+	lame.Add(&DNSConfig{Servers: map[string][]string{"iterative": {"iterative://root?hints=192.0.2.9"}}})
+	q, _ := newquery(1, "www.test", dnsmessage.TypeA)
+	if _, err := lame.exchange(context.Background(), q); !errors.Is(err, ErrLameDelegation) {
+		t.Fatal("unexpected", err)
+	}
+}
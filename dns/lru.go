@@ -0,0 +1,249 @@
+package dns
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheSize bounds a Cache with zero size
+	DefaultCacheSize = 4096
+	// DefaultCacheTTL expires the entries of a Cache with zero ttl
+	DefaultCacheTTL = time.Hour
+)
+
+// CacheEntry is a cached answer
+type CacheEntry struct {
+	Name    string
+	Addrs   []string
+	Expires time.Time
+	value   any // value is kept by store instead of Addrs
+}
+
+// CacheStats are the counters of a Cache
+type CacheStats struct {
+	Len       int
+	Size      int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64 // Evictions are the live entries dropped by size
+}
+
+// Cache keeps the addresses of names in LRU order, bounded by size.
+// Its zero value uses DefaultCacheSize and DefaultCacheTTL.
+type Cache struct {
+	mu        sync.Mutex
+	size      int
+	ttl       time.Duration
+	ll        list.List // ll holds *CacheEntry, the most recent first
+	m         map[string]*list.Element
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	disk      *cachefile // disk is purged along with the public removals
+	linked    sync.Map   // linked are the *Cache purged along with c
+}
+
+// HostCache caches the answers of LookupHost
+var HostCache = Cache{disk: &diskCache}
+
+// SetLimit bounds c to size entries living ttl, 0 means the defaults
+func (c *Cache) SetLimit(size int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size, c.ttl = size, ttl
+	c.shrink(c.limit())
+}
+
+// lifetime of the entries set without their own ttl
+func (c *Cache) lifetime() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 {
+		return DefaultCacheTTL
+	}
+	return c.ttl
+}
+
+// limit no lock, use under lock
+func (c *Cache) limit() int {
+	if c.size <= 0 {
+		return DefaultCacheSize
+	}
+	return c.size
+}
+
+// shrink evicts the least recent entries beyond n, no lock, use under lock
+func (c *Cache) shrink(n int) {
+	now := time.Now()
+	for c.ll.Len() > n {
+		e := c.ll.Back()
+		ent := e.Value.(*CacheEntry)
+		if now.Before(ent.Expires) {
+			c.evictions++
+		}
+		c.remove(e)
+	}
+}
+
+// remove no lock, use under lock
+func (c *Cache) remove(e *list.Element) {
+	delete(c.m, e.Value.(*CacheEntry).Name)
+	c.ll.Remove(e)
+}
+
+// Get a copy of the unexpired addrs of name
+func (c *Cache) Get(name string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ent := c.get(name); ent != nil && ent.Addrs != nil {
+		return append([]string(nil), ent.Addrs...)
+	}
+	return nil
+}
+
+// load the unexpired value of name kept by store
+func (c *Cache) load(name string) any {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ent := c.get(name); ent != nil {
+		return ent.value
+	}
+	return nil
+}
+
+// get no lock, use under lock
+func (c *Cache) get(name string) *CacheEntry {
+	e, ok := c.m[name]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	ent := e.Value.(*CacheEntry)
+	if !time.Now().Before(ent.Expires) {
+		c.remove(e)
+		c.misses++
+		return nil
+	}
+	c.ll.MoveToFront(e)
+	c.hits++
+	return ent
+}
+
+// Set the addrs of name as the most recent entry
+func (c *Cache) Set(name string, addrs []string) {
+	c.setttl(name, addrs, 0)
+}
+
+// setttl sets name to live ttl instead of the one of c if ttl > 0
+func (c *Cache) setttl(name string, addrs []string, ttl time.Duration) {
+	c.put(&CacheEntry{Name: name, Addrs: addrs}, ttl)
+}
+
+// store v as name living ttl instead of the one of c if ttl > 0
+func (c *Cache) store(name string, v any, ttl time.Duration) {
+	c.put(&CacheEntry{Name: name, value: v}, ttl)
+}
+
+// put ent as the most recent entry
+func (c *Cache) put(ent *CacheEntry, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	ent.Expires = time.Now().Add(ttl)
+	if e, ok := c.m[ent.Name]; ok {
+		e.Value = ent
+		c.ll.MoveToFront(e)
+		return
+	}
+	if c.m == nil {
+		c.m = map[string]*list.Element{}
+	}
+	c.m[ent.Name] = c.ll.PushFront(ent)
+	c.shrink(c.limit())
+}
+
+// Delete the entries of name, including those for client subnets,
+// e.g. a poisoned one
+func (c *Cache) Delete(name string) {
+	name = normname(name)
+	c.mu.Lock()
+	if e, ok := c.m[name]; ok {
+		c.remove(e)
+	}
+	for n, e := range c.m {
+		if strings.HasPrefix(n, name+" ") {
+			c.remove(e)
+		}
+	}
+	c.mu.Unlock()
+	if c.disk != nil {
+		c.disk.delete(name)
+	}
+	c.linked.Range(func(l, _ any) bool {
+		l.(*Cache).Delete(name)
+		return true
+	})
+}
+
+// Flush all entries
+func (c *Cache) Flush() {
+	c.flush()
+	if c.disk != nil {
+		c.disk.flush()
+	}
+	c.linked.Range(func(l, _ any) bool {
+		l.(*Cache).Flush()
+		return true
+	})
+}
+
+// link purges l along with the public removals of c until unlink
+func (c *Cache) link(l *Cache) (unlink func()) {
+	c.linked.Store(l, struct{}{})
+	return func() {
+		c.linked.Delete(l)
+	}
+}
+
+// flush the memory only
+func (c *Cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.m = nil
+}
+
+// Entries are the unexpired entries, the most recent first
+func (c *Cache) Entries() []CacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	ents := make([]CacheEntry, 0, c.ll.Len())
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		ent := e.Value.(*CacheEntry)
+		if now.Before(ent.Expires) {
+			ents = append(ents, CacheEntry{
+				Name: ent.Name, Addrs: append([]string(nil), ent.Addrs...), Expires: ent.Expires,
+			})
+		}
+	}
+	return ents
+}
+
+// Stats are the current counters of c
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Len: c.ll.Len(), Size: c.limit(),
+		Hits: c.hits, Misses: c.misses, Evictions: c.evictions,
+	}
+}
@@ -0,0 +1,49 @@
+package dns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheLRU(t *testing.T) {
+	disk := &cachefile{m: map[string]*cachefileentry{}}
+	c := Cache{disk: disk}
+	c.SetLimit(2, time.Hour)
+	c.Set("a.terasu.test", []string{"192.0.2.1"})
+	c.Set("b.terasu.test", []string{"192.0.2.2"})
+	disk.put("a.terasu.test", []string{"192.0.2.1"})
+	if c.Get("a.terasu.test") == nil {
+		t.Fatal("missing a")
+	}
+	c.Set("c.terasu.test", []string{"192.0.2.3"})
+	if c.Get("b.terasu.test") != nil {
+		t.Fatal("b is not evicted")
+	}
+	ents := c.Entries()
+	if len(ents) != 2 || ents[0].Name != "c.terasu.test" || ents[1].Name != "a.terasu.test" {
+		t.Fatal("unexpected", ents)
+	}
+	st := c.Stats()
+	if st.Len != 2 || st.Size != 2 || st.Hits != 1 || st.Misses != 1 || st.Evictions != 1 {
+		t.Fatalf("unexpected %+v", st)
+	}
+
+	c.Delete("A.terasu.test.")
+	if c.Get("a.terasu.test") != nil || disk.get("a.terasu.test") != nil {
+		t.Fatal("a is not deleted")
+	}
+	c.Flush()
+	if c.Stats().Len != 0 || len(c.Entries()) != 0 {
+		t.Fatal("not flushed")
+	}
+
+	c.SetLimit(0, time.Millisecond)
+	c.Set("d.terasu.test", []string{"192.0.2.4"})
+	time.Sleep(time.Millisecond * 5)
+	if c.Get("d.terasu.test") != nil || len(c.Entries()) != 0 {
+		t.Fatal("d is not expired")
+	}
+	if st = c.Stats(); st.Size != DefaultCacheSize || st.Evictions != 1 {
+		t.Fatalf("unexpected %+v", st)
+	}
+}
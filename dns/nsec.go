@@ -0,0 +1,325 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxNSEC3Iterations above which a zone is treated as insecure (RFC 9276 3.2)
+const maxNSEC3Iterations = 150
+
+// types of the bit maps known to dnsmessage
+const (
+	typeNS    = uint16(dnsmessage.TypeNS)
+	typeCNAME = uint16(dnsmessage.TypeCNAME)
+	typeSOA   = uint16(dnsmessage.TypeSOA)
+)
+
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// denial is what the NSEC or NSEC3 records of a negative answer prove
+type denial struct {
+	proven bool
+	// insecure is an opt-out span or too many iterations
+	insecure bool
+	// delegation is an NS without SOA at the name
+	delegation bool
+}
+
+// hastype tells whether typ is in the type bit maps (RFC 4034 4.1.2)
+func hastype(bitmap []byte, typ uint16) bool {
+	window, bit := byte(typ>>8), typ&0xff
+	for len(bitmap) >= 2 {
+		w, n := bitmap[0], int(bitmap[1])
+		if n > 32 || len(bitmap) < 2+n {
+			return false
+		}
+		if w == window {
+			i := int(bit / 8)
+			return i < n && bitmap[2+i]&(0x80>>(bit%8)) != 0
+		}
+		bitmap = bitmap[2+n:]
+	}
+	return false
+}
+
+// nsec is the rdata of an NSEC (RFC 4034 4.1)
+type nsec struct {
+	owner  string
+	next   string
+	bitmap []byte
+}
+
+// covers tells whether name is strictly between owner and next
+func (n *nsec) covers(name string) bool {
+	if compareNames(n.owner, n.next) < 0 {
+		return compareNames(n.owner, name) < 0 && compareNames(name, n.next) < 0
+	}
+	// the last nsec wraps to the apex
+	return compareNames(n.owner, name) < 0 || compareNames(name, n.next) < 0
+}
+
+func parsensecs(sets []*rrset) (lst []*nsec) {
+	for _, set := range sets {
+		if set.typ != typeNSEC {
+			continue
+		}
+		for _, r := range set.rrs {
+			next, off, err := readname(r.data, 0)
+			if err != nil {
+				continue
+			}
+			lst = append(lst, &nsec{owner: set.name, next: next, bitmap: r.data[off:]})
+		}
+	}
+	return
+}
+
+// commonancestor is the deepest common ancestor of a and b
+func commonancestor(a, b string) string {
+	la, lb := labels(a), labels(b)
+	i := 0
+	for i < len(la) && i < len(lb) && la[len(la)-1-i] == lb[len(lb)-1-i] {
+		i++
+	}
+	if i == 0 {
+		return "."
+	}
+	return strings.Join(la[len(la)-i:], ".") + "."
+}
+
+// nsecdenial checks the NSECs of a negative answer of name in typ (RFC 4035 5.4)
+func nsecdenial(lst []*nsec, name string, typ uint16, nxdomain bool) (d denial) {
+	for _, n := range lst {
+		if n.owner != name {
+			continue
+		}
+		if nxdomain || hastype(n.bitmap, typ) || hastype(n.bitmap, typeCNAME) {
+			return
+		}
+		d.proven = true
+		d.delegation = hastype(n.bitmap, typeNS) && !hastype(n.bitmap, typeSOA)
+		return
+	}
+	for _, n := range lst {
+		if !n.covers(name) {
+			continue
+		}
+		// the wildcard at the closest encloser must not exist either
+		ce := commonancestor(name, n.owner)
+		if c := commonancestor(name, n.next); len(c) > len(ce) {
+			ce = c
+		}
+		wildcard := "*." + ce
+		if ce == "." {
+			wildcard = "*."
+		}
+		for _, w := range lst {
+			if w.covers(wildcard) {
+				d.proven = true
+				return
+			}
+			if w.owner == wildcard && !nxdomain && !hastype(w.bitmap, typ) && !hastype(w.bitmap, typeCNAME) {
+				d.proven = true // nodata of a wildcard
+				return
+			}
+		}
+		return
+	}
+	return
+}
+
+// nsec3 is the rdata of an NSEC3 (RFC 5155 3)
+type nsec3 struct {
+	owner      []byte // owner is the decoded hash of the first label
+	zone       string
+	alg        uint8
+	optout     bool
+	iterations uint16
+	salt       []byte
+	next       []byte
+	bitmap     []byte
+}
+
+func (n *nsec3) covers(h []byte) bool {
+	if bytes.Compare(n.owner, n.next) < 0 {
+		return bytes.Compare(n.owner, h) < 0 && bytes.Compare(h, n.next) < 0
+	}
+	return bytes.Compare(n.owner, h) < 0 || bytes.Compare(h, n.next) < 0
+}
+
+func parsensec3s(sets []*rrset) (lst []*nsec3) {
+	for _, set := range sets {
+		if set.typ != typeNSEC3 {
+			continue
+		}
+		first, zone, _ := strings.Cut(set.name, ".")
+		owner, err := nsec3Encoding.DecodeString(strings.ToUpper(first))
+		if err != nil {
+			continue
+		}
+		if zone == "" {
+			zone = "."
+		}
+		for _, r := range set.rrs {
+			b := r.data
+			if len(b) < 5 {
+				continue
+			}
+			n := &nsec3{owner: owner, zone: zone, alg: b[0], optout: b[1]&1 != 0, iterations: binary.BigEndian.Uint16(b[2:])}
+			saltlen := int(b[4])
+			if len(b) < 6+saltlen {
+				continue
+			}
+			n.salt = b[5 : 5+saltlen]
+			hashlen := int(b[5+saltlen])
+			off := 6 + saltlen
+			if len(b) < off+hashlen {
+				continue
+			}
+			n.next = b[off : off+hashlen]
+			n.bitmap = b[off+hashlen:]
+			lst = append(lst, n)
+		}
+	}
+	return
+}
+
+// nsec3hash of a canonical name (RFC 5155 5)
+func nsec3hash(name string, salt []byte, iterations uint16) []byte {
+	h := sha1.New()
+	h.Write(appendname(nil, name))
+	h.Write(salt)
+	sum := h.Sum(nil)
+	for i := 0; i < int(iterations); i++ {
+		h.Reset()
+		h.Write(sum)
+		h.Write(salt)
+		sum = h.Sum(sum[:0])
+	}
+	return sum
+}
+
+// nsec3denial checks the NSEC3s of a negative answer of name in typ (RFC 5155 8)
+func nsec3denial(lst []*nsec3, name string, typ uint16, nxdomain bool) (d denial) {
+	if len(lst) == 0 {
+		return
+	}
+	p := lst[0]
+	if p.alg != 1 {
+		return
+	}
+	if p.iterations > maxNSEC3Iterations {
+		d.proven, d.insecure = true, true
+		return
+	}
+	hashof := func(n string) []byte { return nsec3hash(n, p.salt, p.iterations) }
+	match := func(h []byte) *nsec3 {
+		for _, n := range lst {
+			if bytes.Equal(n.owner, h) {
+				return n
+			}
+		}
+		return nil
+	}
+	cover := func(h []byte) *nsec3 {
+		for _, n := range lst {
+			if n.covers(h) {
+				return n
+			}
+		}
+		return nil
+	}
+	if !nxdomain {
+		if n := match(hashof(name)); n != nil {
+			if hastype(n.bitmap, typ) || hastype(n.bitmap, typeCNAME) {
+				return
+			}
+			d.proven = true
+			d.delegation = hastype(n.bitmap, typeNS) && !hastype(n.bitmap, typeSOA)
+			return
+		}
+	}
+	// closest encloser proof
+	l := labels(name)
+	for i := 1; i < len(l); i++ {
+		ce := strings.Join(l[i:], ".") + "."
+		if !issubdomain(ce, p.zone) {
+			break
+		}
+		if match(hashof(ce)) == nil {
+			continue
+		}
+		nextcloser := strings.Join(l[i-1:], ".") + "."
+		c := cover(hashof(nextcloser))
+		if c == nil {
+			return
+		}
+		if c.optout {
+			// an unsigned delegation may hide in the span
+			if nxdomain || typ == typeDS {
+				d.proven, d.insecure = true, true
+			}
+			return
+		}
+		if !nxdomain {
+			// nodata of a wildcard
+			if w := match(hashof("*." + ce)); w != nil && !hastype(w.bitmap, typ) && !hastype(w.bitmap, typeCNAME) {
+				d.proven = true
+			}
+			return
+		}
+		d.proven = cover(hashof("*."+ce)) != nil
+		return
+	}
+	return
+}
+
+// expanded checks that name answered by a wildcard of n labels does not
+// exist, by an NSEC covering it or an NSEC3 covering the next closer name
+// (RFC 4035 5.3.4, RFC 5155 8.8)
+func expanded(sets []*rrset, name string, n int) (d denial) {
+	if lst := parsensecs(sets); len(lst) > 0 {
+		for _, c := range lst {
+			if c.covers(name) {
+				d.proven = true
+				return
+			}
+		}
+		return
+	}
+	lst := parsensec3s(sets)
+	if len(lst) == 0 || lst[0].alg != 1 {
+		return
+	}
+	p := lst[0]
+	if p.iterations > maxNSEC3Iterations {
+		d.proven, d.insecure = true, true
+		return
+	}
+	l := labels(name)
+	if n >= len(l) {
+		return
+	}
+	h := nsec3hash(strings.Join(l[len(l)-n-1:], ".")+".", p.salt, p.iterations)
+	for _, c := range lst {
+		if c.covers(h) {
+			d.proven = true
+			return
+		}
+	}
+	return
+}
+
+// deny checks the signed NSEC or NSEC3 records of sets
+func deny(sets []*rrset, name string, typ uint16, nxdomain bool) denial {
+	if lst := parsensecs(sets); len(lst) > 0 {
+		return nsecdenial(lst, name, typ, nxdomain)
+	}
+	return nsec3denial(parsensec3s(sets), name, typ, nxdomain)
+}
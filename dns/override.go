@@ -0,0 +1,297 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxAliasDepth limits the CNAME chain of overrides
+const maxAliasDepth = 8
+
+var (
+	// ErrInvalidOverride is reported on malformed patterns or addresses
+	ErrInvalidOverride = errors.New("invalid override")
+	// ErrAliasLoop is reported when aliases of overrides are too deep
+	ErrAliasLoop = errors.New("override alias loop")
+)
+
+// Override is the answer of a pattern, either addresses or an alias
+type Override struct {
+	Addrs []string
+	// Alias resolves the pattern as another name like a CNAME
+	Alias string
+}
+
+// Overrides are static answers consulted before cache and upstreams.
+// A pattern is one of
+//
+//	api.example.com    exact name
+//	.example.com       example.com and all its subdomains
+//	*.cdn.example      any single label in place of *, like img-*.cdn.example
+//
+// An exact pattern wins over wildcards, which win over suffixes,
+// and the longest suffix wins among suffixes.
+type Overrides struct {
+	mu       sync.RWMutex
+	exact    map[string]Override
+	wildcard map[string]Override
+	wildseq  []string // wildseq are the keys of wildcard sorted for a stable choice
+	suffix   map[string]Override
+}
+
+// HostOverrides is consulted by LookupHost
+var HostOverrides Overrides
+
+// normname lowercases name into A-labels without the trailing dot,
+// an invalid label is kept as is
+func normname(name string) string {
+	if a, err := ToASCII(name); err == nil {
+		return a
+	}
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (o *Overrides) set(pattern string, ov Override) error {
+	pattern, err := ToASCII(pattern)
+	if err != nil {
+		return err
+	}
+	if pattern == "" || pattern == "." {
+		return ErrInvalidOverride
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch {
+	case strings.HasPrefix(pattern, "."):
+		if o.suffix == nil {
+			o.suffix = map[string]Override{}
+		}
+		o.suffix[pattern[1:]] = ov
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return ErrInvalidOverride
+		}
+		o.setwildcard(pattern, ov)
+	default:
+		if o.exact == nil {
+			o.exact = map[string]Override{}
+		}
+		o.exact[pattern] = ov
+	}
+	return nil
+}
+
+// setwildcard no lock, use under lock
+func (o *Overrides) setwildcard(pattern string, ov Override) {
+	if o.wildcard == nil {
+		o.wildcard = map[string]Override{}
+	}
+	if _, ok := o.wildcard[pattern]; !ok {
+		i := sort.SearchStrings(o.wildseq, pattern)
+		o.wildseq = append(o.wildseq, "")
+		copy(o.wildseq[i+1:], o.wildseq[i:])
+		o.wildseq[i] = pattern
+	}
+	o.wildcard[pattern] = ov
+}
+
+// Set pins pattern to addrs
+func (o *Overrides) Set(pattern string, addrs ...string) error {
+	if len(addrs) == 0 {
+		return ErrInvalidOverride
+	}
+	lst := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return ErrInvalidOverride
+		}
+		lst = append(lst, ip.String())
+	}
+	return o.set(pattern, Override{Addrs: lst})
+}
+
+// Alias resolves pattern as target
+func (o *Overrides) Alias(pattern, target string) error {
+	target, err := ToASCII(target)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		return ErrInvalidOverride
+	}
+	return o.set(pattern, Override{Alias: target})
+}
+
+// Delete the override of pattern
+func (o *Overrides) Delete(pattern string) {
+	pattern = normname(pattern)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if strings.HasPrefix(pattern, ".") {
+		delete(o.suffix, pattern[1:])
+		return
+	}
+	delete(o.exact, pattern)
+	if _, ok := o.wildcard[pattern]; ok {
+		delete(o.wildcard, pattern)
+		i := sort.SearchStrings(o.wildseq, pattern)
+		o.wildseq = append(o.wildseq[:i], o.wildseq[i+1:]...)
+	}
+}
+
+// Reset removes all overrides
+func (o *Overrides) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.exact, o.wildcard, o.wildseq, o.suffix = nil, nil, nil, nil
+}
+
+// Lookup the override of name
+func (o *Overrides) Lookup(name string) (Override, bool) {
+	name = normname(name)
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if ov, ok := o.exact[name]; ok {
+		return ov, true
+	}
+	for _, p := range o.wildseq {
+		if matchlabels(p, name) {
+			return o.wildcard[p], true
+		}
+	}
+	for s := name; ; {
+		if ov, ok := o.suffix[s]; ok {
+			return ov, true
+		}
+		i := strings.IndexByte(s, '.')
+		if i < 0 {
+			return Override{}, false
+		}
+		s = s[i+1:]
+	}
+}
+
+// matchlabels matches name against pattern label by label
+func matchlabels(pattern, name string) bool {
+	pl, nl := strings.Split(pattern, "."), strings.Split(name, ".")
+	if len(pl) != len(nl) {
+		return false
+	}
+	for i := range pl {
+		if ok, _ := path.Match(pl[i], nl[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// LoadHosts imports overrides in the format of /etc/hosts, that is
+// an address followed by names per line and # starts a comment.
+// Names of several lines accumulate their addresses. Addresses with
+// a zone like fe80::1%lo0 are skipped. Nothing is imported on error.
+func (o *Overrides) LoadHosts(r io.Reader) error {
+	m := map[string][]string{}
+	lines := map[string]int{} // lines are where the names first appear
+	var seq []string
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		a, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return fmt.Errorf("line %d: %w: %s", n, ErrInvalidOverride, fields[0])
+		}
+		if a.Zone() != "" {
+			continue
+		}
+		ip := a.Unmap().String()
+		for _, name := range fields[1:] {
+			name = normname(name)
+			if _, ok := m[name]; !ok {
+				seq = append(seq, name)
+				lines[name] = n
+			}
+			if !hasfallback(m[name], ip) {
+				m[name] = append(m[name], ip)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	tmp := Overrides{}
+	for _, name := range seq {
+		if err := tmp.Set(name, m[name]...); err != nil {
+			return fmt.Errorf("line %d: %w: %s", lines[name], err, name)
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for name, ov := range tmp.exact {
+		if o.exact == nil {
+			o.exact = map[string]Override{}
+		}
+		o.exact[name] = ov
+	}
+	for name, ov := range tmp.suffix {
+		if o.suffix == nil {
+			o.suffix = map[string]Override{}
+		}
+		o.suffix[name] = ov
+	}
+	for name, ov := range tmp.wildcard {
+		o.setwildcard(name, ov)
+	}
+	return nil
+}
+
+// LoadHostsFile imports overrides from a hosts file
+func (o *Overrides) LoadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return o.LoadHosts(f)
+}
+
+// resolve host by overrides, following aliases and looking up the
+// final name by lookup if it has no override. ok is false if host
+// has no override at all.
+func (o *Overrides) resolve(
+	ctx context.Context, host string, lookup func(ctx context.Context, host string) ([]string, error),
+) (addrs []string, ok bool, err error) {
+	name := host
+	for i := 0; i < maxAliasDepth; i++ {
+		ov, found := o.Lookup(name)
+		if !found {
+			if i == 0 {
+				return nil, false, nil
+			}
+			addrs, err = lookup(ctx, name)
+			return addrs, true, err
+		}
+		if ov.Alias == "" {
+			return append([]string(nil), ov.Addrs...), true, nil
+		}
+		name = ov.Alias
+	}
+	return nil, true, ErrAliasLoop
+}
@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestOverrides(t *testing.T) {
+	o := Overrides{}
+	if err := o.Set("api.example.com", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set("*.cdn.example", "192.0.2.2", "2001:db8::2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set(".example.com", "192.0.2.3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set(".deep.example.com", "192.0.2.4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Set("bad.example.com", "nope"); err == nil {
+		t.Fatal("expected error")
+	}
+	for name, want := range map[string]string{
+		"API.example.com.":   "192.0.2.1",
+		"img.cdn.example":    "192.0.2.2",
+		"a.img.cdn.example":  "",
+		"example.com":        "192.0.2.3",
+		"www.example.com":    "192.0.2.3",
+		"x.deep.example.com": "192.0.2.4",
+		"notexample.com":     "",
+		"cdn.example":        "",
+	} {
+		ov, ok := o.Lookup(name)
+		if ok != (want != "") || (ok && ov.Addrs[0] != want) {
+			t.Fatal(name, "unexpected", ov, ok)
+		}
+	}
+}
+
+func TestOverridesResolve(t *testing.T) {
+	o := Overrides{}
+	err := o.LoadHosts(strings.NewReader(`
+# comment
+192.0.2.1   hosts.terasu.test  alias1.terasu.test
+2001:db8::1 hosts.terasu.test # trailing
+fe80::1%lo0 hosts.terasu.test
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a bad line fails the whole import
+	err = o.LoadHosts(strings.NewReader("192.0.2.2 partial.terasu.test\nbad partial2.terasu.test\n"))
+	if !errors.Is(err, ErrInvalidOverride) || !strings.Contains(err.Error(), "line 2") {
+		t.Fatal("unexpected", err)
+	}
+	if _, ok := o.Lookup("partial.terasu.test"); ok {
+		t.Fatal("failed import applied")
+	}
+	// so does a bad name, reported at its line too
+	err = o.LoadHosts(strings.NewReader("192.0.2.2 partial.terasu.test\n\n192.0.2.3 xn--a.terasu.test\n"))
+	if !errors.Is(err, ErrInvalidHostname) || !strings.Contains(err.Error(), "line 3") {
+		t.Fatal("unexpected", err)
+	}
+	_ = o.Alias("www.terasu.test", "hosts.terasu.test")
+	_ = o.Alias("out.terasu.test", "upstream.terasu.test")
+	_ = o.Alias("loop1.terasu.test", "loop2.terasu.test")
+	_ = o.Alias("loop2.terasu.test", "loop1.terasu.test")
+	lookup := func(_ context.Context, host string) ([]string, error) {
+		return []string{"lookup " + host}, nil
+	}
+	for name, want := range map[string][]string{
+		"hosts.terasu.test":  {"192.0.2.1", "2001:db8::1"},
+		"alias1.terasu.test": {"192.0.2.1"},
+		"www.terasu.test":    {"192.0.2.1", "2001:db8::1"},
+		"out.terasu.test":    {"lookup upstream.terasu.test"},
+	} {
+		addrs, ok, err := o.resolve(context.Background(), name, lookup)
+		if err != nil || !ok || strings.Join(addrs, ",") != strings.Join(want, ",") {
+			t.Fatal(name, "unexpected", addrs, ok, err)
+		}
+	}
+	if _, ok, _ := o.resolve(context.Background(), "none.terasu.test", lookup); ok {
+		t.Fatal("unexpected override")
+	}
+	if _, _, err := o.resolve(context.Background(), "loop1.terasu.test", lookup); err != ErrAliasLoop {
+		t.Fatal("unexpected", err)
+	}
+}
@@ -0,0 +1,66 @@
+package dns
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// paddingOptionCode is the EDNS(0) padding option (RFC 7830)
+	paddingOptionCode = 12
+	// DefaultPaddingBlock is the block length of queries
+	// recommended by RFC 8467 4.1
+	DefaultPaddingBlock = 128
+)
+
+// padding is the block length of queries to up, 0 means no padding.
+// Only encrypted queries are padded by default (RFC 7830 6).
+func (up *Upstream) padding() int {
+	if up.Padding >= 0 {
+		return up.Padding
+	}
+	switch {
+	case up.Scheme == SchemeTLS:
+		return DefaultPaddingBlock
+	case up.Scheme == SchemeHTTPS && up.Format == DoHFormatWire:
+		return DefaultPaddingBlock
+	}
+	return 0
+}
+
+// withpadding pads the wire query q to a multiple of block,
+// replacing any padding of q and adding an EDNS(0) record if needed
+func withpadding(q []byte, block int) ([]byte, error) {
+	var m dnsmessage.Message
+	err := m.Unpack(q)
+	if err != nil {
+		return nil, err
+	}
+	opt, err := optof(&m)
+	if err != nil {
+		return nil, err
+	}
+	options := opt.Options[:0]
+	for _, o := range opt.Options {
+		if o.Code != paddingOptionCode {
+			options = append(options, o)
+		}
+	}
+	opt.Options = append(options, dnsmessage.Option{Code: paddingOptionCode})
+	msg, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// the option is the last one, just grow its data
+	n := (block - len(msg)%block) % block
+	opt.Options[len(opt.Options)-1].Data = make([]byte, n)
+	return m.Pack()
+}
+
+// applypadding pads q to the block length of up if any
+func applypadding(up *Upstream, q []byte) ([]byte, error) {
+	block := up.padding()
+	if block <= 0 {
+		return q, nil
+	}
+	return withpadding(q, block)
+}
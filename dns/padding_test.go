@@ -0,0 +1,94 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestPaddingPolicy(t *testing.T) {
+	for _, c := range []struct {
+		in    string
+		block int
+	}{
+		{"tls://192.0.2.1", DefaultPaddingBlock},
+		{"tls://192.0.2.1?padding=0", 0},
+		{"https://doh.terasu.test/dns-query?format=wire", DefaultPaddingBlock},
+		{"https://doh.terasu.test/resolve", 0},
+		{"udp://192.0.2.1", 0},
+		{"tcp://192.0.2.1?padding=64", 64},
+	} {
+		up, err := ParseUpstream(c.in)
+		if err != nil {
+			t.Fatal(c.in, err)
+		}
+		if up.padding() != c.block {
+			t.Fatalf("%s: unexpected %d", c.in, up.padding())
+		}
+		up2, err := ParseUpstream(up.String())
+		if err != nil || up2.padding() != c.block {
+			t.Fatal("unstable", up.String(), err)
+		}
+	}
+	if _, err := ParseUpstream("tls://192.0.2.1?padding=-1"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestPaddingSize(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sizes := make(chan int, 1)
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			sizes <- n
+			resp, err := fakeresponse(buf[:n], fakeanswer("192.0.2.1", ""))
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	stat, err := newdnsstat("udp://" + conn.LocalAddr().String() + "?padding=128")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := racer{host: "local", addr: stat}
+	s := &serverset{}
+	ctx := WithECS(context.Background(), &ECS{Prefix: netip.MustParsePrefix("2001:db8::/56")})
+	for _, name := range []string{"a.test", strings.Repeat("b", 60) + ".terasu.test", strings.Repeat("c.", 70) + "test"} {
+		q, err := newquery(1, name, dnsmessage.TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ctx := range []context.Context{context.Background(), ctx} {
+			if _, err = r.exchange(ctx, q, s); err != nil {
+				t.Fatal(err)
+			}
+			if n := <-sizes; n%128 != 0 || n < len(q) {
+				t.Fatal(name, "unexpected size", n)
+			}
+		}
+		// padding again replaces the old option
+		p, err := withpadding(q, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p2, err := withpadding(p, 128)
+		if err != nil || len(p2) != len(p) {
+			t.Fatal("unexpected", len(p), len(p2), err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// cacheFileSaveDelay merges bursts of new answers into one write
+	cacheFileSaveDelay = time.Second * 10
+	// maxCacheFileEntries bounds the store, the oldest ones are pruned first
+	maxCacheFileEntries = DefaultCacheSize
+)
+
+var (
+	// ErrCacheFileNotSet is reported when saving without SetCacheFile
+	ErrCacheFileNotSet = errors.New("cache file not set")
+)
+
+type cachefileentry struct {
+	Addrs []string  `json:"addrs"`
+	Time  time.Time `json:"time"`
+}
+
+type cachefilecontent struct {
+	Version int                        `json:"version"`
+	Entries map[string]*cachefileentry `json:"entries"`
+}
+
+// cachefile keeps successfully resolved addresses on disk
+type cachefile struct {
+	mu     sync.Mutex
+	path   string
+	maxAge time.Duration
+	m      map[string]*cachefileentry
+	timer  *time.Timer
+}
+
+var diskCache = cachefile{m: map[string]*cachefileentry{}}
+
+// SetCacheFile enables the on-disk store of resolved addresses at path.
+// Entries that are not older than maxAge (0 means no limit) are loaded
+// into the cache as warm data and used as the last-known-good fallback
+// after all servers failed. New answers are written back automatically.
+// A file that cannot be read or parsed is reported and left untouched.
+func SetCacheFile(path string, maxAge time.Duration) error {
+	return diskCache.open(path, maxAge)
+}
+
+// SaveCacheFile writes the store to disk immediately, call it before exit
+func SaveCacheFile() error {
+	return diskCache.save()
+}
+
+func (cf *cachefile) open(path string, maxAge time.Duration) error {
+	var c cachefilecontent
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		// a broken file is kept as is instead of being saved over
+		if err = json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.path = path
+	cf.maxAge = maxAge
+	for host, ent := range c.Entries {
+		if ent == nil || len(ent.Addrs) == 0 || cf.expired(ent) {
+			continue
+		}
+		if old, ok := cf.m[host]; ok && old.Time.After(ent.Time) {
+			continue
+		}
+		cf.m[host] = ent
+		// warm the cache for what is left of the lifetime of the answer
+		if ttl := HostCache.lifetime() - time.Since(ent.Time); ttl > 0 {
+			HostCache.setttl(host, ent.Addrs, ttl)
+		}
+	}
+	logrus.Debugln("[terasu.dns] loaded", len(cf.m), "entries from", path)
+	return nil
+}
+
+// expired no lock, use under lock
+func (cf *cachefile) expired(ent *cachefileentry) bool {
+	return cf.maxAge > 0 && time.Since(ent.Time) > cf.maxAge
+}
+
+// put the addrs of host if the store is set
+func (cf *cachefile) put(host string, addrs []string) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.path == "" {
+		return
+	}
+	if _, ok := cf.m[host]; !ok && len(cf.m) >= maxCacheFileEntries {
+		cf.prune()
+	}
+	cf.m[host] = &cachefileentry{Addrs: addrs, Time: time.Now()}
+	cf.schedule()
+}
+
+// prune the expired entries, then the oldest one if still full,
+// no lock, use under lock
+func (cf *cachefile) prune() {
+	oldest := ""
+	for host, ent := range cf.m {
+		if cf.expired(ent) {
+			delete(cf.m, host)
+			continue
+		}
+		if oldest == "" || ent.Time.Before(cf.m[oldest].Time) {
+			oldest = host
+		}
+	}
+	if len(cf.m) >= maxCacheFileEntries {
+		delete(cf.m, oldest)
+	}
+}
+
+func (cf *cachefile) delete(host string) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if _, ok := cf.m[host]; ok {
+		delete(cf.m, host)
+		cf.schedule()
+	}
+}
+
+func (cf *cachefile) flush() {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if len(cf.m) > 0 {
+		cf.m = map[string]*cachefileentry{}
+		cf.schedule()
+	}
+}
+
+// schedule a save, no lock, use under lock
+func (cf *cachefile) schedule() {
+	if cf.path == "" || cf.timer != nil {
+		return
+	}
+	cf.timer = time.AfterFunc(cacheFileSaveDelay, func() {
+		err := cf.save()
+		if err != nil {
+			logrus.Warnln("[terasu.dns] save cache file err:", err)
+		}
+	})
+}
+
+// get the last-known-good addrs of host if the store is set
+func (cf *cachefile) get(host string) []string {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.path == "" {
+		return nil
+	}
+	ent, ok := cf.m[host]
+	if !ok || cf.expired(ent) {
+		return nil
+	}
+	return ent.Addrs
+}
+
+func (cf *cachefile) save() error {
+	cf.mu.Lock()
+	if cf.timer != nil {
+		cf.timer.Stop()
+		cf.timer = nil
+	}
+	path := cf.path
+	if path == "" {
+		cf.mu.Unlock()
+		return ErrCacheFileNotSet
+	}
+	c := cachefilecontent{Version: 1, Entries: make(map[string]*cachefileentry, len(cf.m))}
+	for host, ent := range cf.m {
+		if !cf.expired(ent) {
+			c.Entries[host] = ent
+		}
+	}
+	data, err := json.Marshal(&c)
+	cf.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes to a temp file in the same dir then renames it
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package dns
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.json")
+	cf := cachefile{m: map[string]*cachefileentry{}}
+	// nothing is kept or served without a file
+	cf.put("persist.terasu.test", []string{"192.0.2.1"})
+	if len(cf.m) != 0 || cf.get("persist.terasu.test") != nil {
+		t.Fatal("unexpected", cf.m)
+	}
+	err := cf.open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.put("persist.terasu.test", []string{"192.0.2.1", "2001:db8::1"})
+	cf.m["stale.terasu.test"] = &cachefileentry{
+		Addrs: []string{"192.0.2.2"}, Time: time.Now().Add(-2 * time.Hour),
+	}
+	cf.m["aged.terasu.test"] = &cachefileentry{
+		Addrs: []string{"192.0.2.3"}, Time: time.Now().Add(-50 * time.Minute),
+	}
+	err = cf.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(path + ".*.tmp")
+	if len(matches) > 0 {
+		t.Fatal("temp file left:", matches)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	HostCache.Delete("persist.terasu.test")
+	HostCache.Delete("aged.terasu.test")
+	defer HostCache.Delete("aged.terasu.test")
+	cf2 := cachefile{m: map[string]*cachefileentry{}}
+	err = cf2.open(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := cf2.get("persist.terasu.test"); len(addrs) != 2 {
+		t.Fatal("unexpected fallback", addrs)
+	}
+	if addrs := cf2.get("stale.terasu.test"); len(addrs) != 0 {
+		t.Fatal("unexpected stale", addrs)
+	}
+	if addrs := HostCache.Get("persist.terasu.test"); len(addrs) != 2 {
+		t.Fatal("cache not warmed", addrs)
+	}
+	// the loaded answers live only what is left of their ttl
+	if HostCache.Get("aged.terasu.test") == nil {
+		t.Fatal("cache not warmed by aged entry")
+	}
+	for _, ent := range HostCache.Entries() {
+		if ent.Name == "aged.terasu.test" && time.Until(ent.Expires) > 11*time.Minute {
+			t.Fatal("unexpected expiry", ent.Expires)
+		}
+	}
+
+	for i := 0; i < maxCacheFileEntries+1; i++ {
+		cf2.put(strconv.Itoa(i)+".terasu.test", []string{"192.0.2.1"})
+	}
+	if len(cf2.m) != maxCacheFileEntries {
+		t.Fatal("unexpected size", len(cf2.m))
+	}
+}
+
+func TestCacheFileBroken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.json")
+	err := os.WriteFile(path, []byte("{broken"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf := cachefile{m: map[string]*cachefileentry{}}
+	if err = cf.open(path, time.Hour); err == nil {
+		t.Fatal("expected error")
+	}
+	cf.put("broken.terasu.test", []string{"192.0.2.1"})
+	_ = cf.save()
+	if data, _ := os.ReadFile(path); string(data) != "{broken" {
+		t.Fatal("broken file overwritten", string(data))
+	}
+}
@@ -0,0 +1,132 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// exchanger sends a wire query and returns the wire response of the same id
+type exchanger func(ctx context.Context, q []byte) ([]byte, error)
+
+type pipeaddr struct{}
+
+func (pipeaddr) Network() string { return "terasu" }
+func (pipeaddr) String() string  { return "terasu.dns" }
+
+type piperesult struct {
+	msg []byte
+	err error
+}
+
+// pipeconn is a virtual stream conn for the go resolver. It hands every
+// framed query to exchange and frames the responses back in the order
+// they arrive, so that queries of the go resolver can reach pooled or
+// non-stream servers.
+type pipeconn struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	exchange exchanger
+	results  chan piperesult
+
+	mu       sync.Mutex
+	wbuf     []byte
+	rbuf     []byte
+	deadline time.Time
+}
+
+func newpipeconn(ctx context.Context, exchange exchanger) *pipeconn {
+	ctx, cancel := context.WithCancel(ctx)
+	return &pipeconn{
+		ctx:      ctx,
+		cancel:   cancel,
+		exchange: exchange,
+		results:  make(chan piperesult, 4),
+	}
+}
+
+// Write buffers b and starts exchanging each complete message
+func (c *pipeconn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ctx.Err() != nil {
+		return 0, net.ErrClosed
+	}
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= 2 {
+		n := int(binary.BigEndian.Uint16(c.wbuf)) + 2
+		if len(c.wbuf) < n {
+			break
+		}
+		q := append([]byte(nil), c.wbuf[2:n]...)
+		c.wbuf = c.wbuf[n:]
+		go func() {
+			msg, err := c.exchange(c.ctx, q)
+			select {
+			case c.results <- piperesult{msg: msg, err: err}:
+			case <-c.ctx.Done():
+			}
+		}()
+	}
+	return len(b), nil
+}
+
+// Read the framed responses
+func (c *pipeconn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.rbuf) == 0 {
+		deadline := c.deadline
+		c.mu.Unlock()
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+		var r piperesult
+		select {
+		case r = <-c.results:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.ctx.Done():
+			return 0, net.ErrClosed
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+		c.mu.Lock()
+		c.rbuf = make([]byte, 2+len(r.msg))
+		binary.BigEndian.PutUint16(c.rbuf, uint16(len(r.msg)))
+		copy(c.rbuf[2:], r.msg)
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	c.mu.Unlock()
+	return n, nil
+}
+
+func (c *pipeconn) Close() error {
+	c.cancel()
+	return nil
+}
+
+func (c *pipeconn) LocalAddr() net.Addr  { return pipeaddr{} }
+func (c *pipeconn) RemoteAddr() net.Addr { return pipeaddr{} }
+
+func (c *pipeconn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *pipeconn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *pipeconn) SetWriteDeadline(time.Time) error {
+	return nil
+}
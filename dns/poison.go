@@ -0,0 +1,141 @@
+package dns
+
+import (
+	"errors"
+	"net/netip"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	// ErrPoisoned is reported when an answer contains a bogon or blocklisted
+	// address, or disagrees with a more trusted server on cross-check
+	ErrPoisoned = errors.New("poisoned answer")
+)
+
+// DefaultBogons are reserved prefixes that never answer a public name.
+// 0.0.0.0/8, 127.0.0.0/8, :: and ::1 are left out, as filtering
+// resolvers answer blocked names by them on purpose.
+var DefaultBogons = []netip.Prefix{
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// PoisonConfig tells how to detect poisoned answers
+type PoisonConfig struct {
+	// Bogons are prefixes never to be answered, DefaultBogons if nil.
+	// Set an empty slice to accept them.
+	Bogons []netip.Prefix
+	// Blocklist are extra prefixes of known fake answers
+	Blocklist []netip.Prefix
+	// CrossCheck verifies each answer of the go resolver by a server of
+	// another host. If they share no address, the answer of the plain DNS
+	// server is discarded in favour of the encrypted one.
+	CrossCheck bool
+}
+
+// SetPoison replaces the poison detection config of ds
+func (ds *DNSList) SetPoison(c PoisonConfig) {
+	ds.update(func(s *serverset) {
+		s.poison = c
+	})
+}
+
+// bogus tells whether a is a bogon or blocklisted
+func (c *PoisonConfig) bogus(a netip.Addr) bool {
+	bogons := c.Bogons
+	if bogons == nil {
+		bogons = DefaultBogons
+	}
+	for _, lst := range [][]netip.Prefix{bogons, c.Blocklist} {
+		for _, p := range lst {
+			// keep mapped addresses for the ::ffff:0:0/96 bogon
+			if p.Contains(a) || p.Contains(a.Unmap()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check the addresses of an answer
+func (c *PoisonConfig) check(hosts []string) error {
+	for _, h := range hosts {
+		a, err := netip.ParseAddr(h)
+		if err != nil {
+			continue
+		}
+		if c.bogus(a) {
+			logrus.Debugln("[terasu.dns] -- poisoned answer", h)
+			return ErrPoisoned
+		}
+	}
+	return nil
+}
+
+// checkmsg checks the A and AAAA records of a wire response
+func (c *PoisonConfig) checkmsg(msg []byte) error {
+	return c.check(answeraddrs(msg))
+}
+
+// answeraddrs are the A and AAAA records of a wire response
+func answeraddrs(msg []byte) []string {
+	var p dnsmessage.Parser
+	_, err := p.Start(msg)
+	if err != nil {
+		return nil
+	}
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return nil
+	}
+	var addrs []string
+	for {
+		rh, err := p.AnswerHeader()
+		if err != nil {
+			return addrs
+		}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return addrs
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A).String())
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return addrs
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA).String())
+		default:
+			if p.SkipAnswer() != nil {
+				return addrs
+			}
+		}
+	}
+}
+
+// disjoint tells whether two non-empty answers share no address
+func disjoint(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for _, x := range a {
+		if hasfallback(b, x) {
+			return false
+		}
+	}
+	return true
+}
+
+// encrypted tells whether the server cannot be spoofed on path
+func (ds *dnsstat) encrypted() bool {
+	return ds.up.Scheme == SchemeTLS || ds.up.Scheme == SchemeHTTPS
+}
@@ -0,0 +1,76 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestPoisonBogons(t *testing.T) {
+	c := PoisonConfig{Blocklist: []netip.Prefix{netip.MustParsePrefix("203.0.113.5/32")}}
+	for h, bogus := range map[string]bool{
+		"127.0.0.1": false, "0.0.0.0": false, "243.185.187.39": true, "::ffff:1.2.3.4": true,
+		"203.0.113.5": true, "192.0.2.1": false, "2001:db8::1": false,
+	} {
+		if err := c.check([]string{h}); (err != nil) != bogus {
+			t.Fatal(h, "unexpected", err)
+		}
+	}
+	c = PoisonConfig{Bogons: []netip.Prefix{}}
+	if err := c.check([]string{"243.185.187.39"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoisonRetry(t *testing.T) {
+	bad := startfakedns(t, fakeanswer("243.185.187.39", ""))
+	good := startfakedns(t, fakeanswer("192.0.2.1", ""))
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"bad": {"udp://" + bad}}})
+	ds.Add(&DNSConfig{Servers: map[string][]string{"good": {"udp://" + good}}})
+	resolver := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return ds.pipe(ctx), nil
+		},
+	}
+	addrs, err := resolver.LookupHost(context.Background(), "poison.terasu.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("unexpected", addrs)
+	}
+	for _, st := range ds.Snapshot() {
+		if st.Host == "bad" && (st.Enabled || st.Failure == 0) {
+			t.Fatal("poisoned server not marked bad", st)
+		}
+	}
+}
+
+func TestPoisonCrossCheck(t *testing.T) {
+	a := startfakedns(t, fakeanswer("192.0.2.1", ""))
+	b := startfakedns(t, fakeanswer("192.0.2.2", ""))
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"a": {"udp://" + a}}})
+	ds.Add(&DNSConfig{Servers: map[string][]string{"b": {"udp://" + b}}})
+	ds.SetPoison(PoisonConfig{CrossCheck: true})
+	q, err := newquery(1, "cross.terasu.test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ds.exchange(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// equally trusted servers disagreeing prove nothing
+	if addrs := answeraddrs(resp); len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("unexpected", addrs)
+	}
+	for _, st := range ds.Snapshot() {
+		if st.Success != 1 || st.Failure != 0 {
+			t.Fatal("unexpected status", st)
+		}
+	}
+}
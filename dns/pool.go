@@ -0,0 +1,332 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrConnIdle is reported to nobody but closes an idle pooled connection
+	ErrConnIdle = errors.New("pooled connection idle")
+	// ErrPoolClosed is reported when using a pool after its server was removed
+	ErrPoolClosed = errors.New("pool closed")
+	// ErrTooManyInflight is reported when a connection runs out of message ids
+	ErrTooManyInflight = errors.New("too many inflight queries")
+)
+
+// dotSessionCache resumes TLS sessions of DoT servers to save round trips
+var dotSessionCache = tls.NewLRUClientSessionCache(64)
+
+// PoolConfig tunes the persistent connections to DoT and TCP servers (RFC 7766)
+type PoolConfig struct {
+	// IdleTimeout closes a connection without outstanding queries, default 30s
+	IdleTimeout time.Duration
+	// MaxConns is the max connections to one server, default 2
+	MaxConns int
+	// MaxInflight is the outstanding queries on one connection before
+	// opening another, default 32
+	MaxInflight int
+}
+
+func (c PoolConfig) withdefaults() PoolConfig {
+	if c.IdleTimeout <= 0 {
+		c.IdleTimeout = time.Second * 30
+	}
+	if c.MaxConns <= 0 {
+		c.MaxConns = 2
+	}
+	if c.MaxInflight <= 0 {
+		c.MaxInflight = 32
+	}
+	return c
+}
+
+// SetPool replaces the pool config, existing connections are kept
+func (ds *DNSList) SetPool(c PoolConfig) {
+	ds.update(func(s *serverset) {
+		s.pool = c
+	})
+}
+
+// streampool keeps pipelined stream connections to one server
+type streampool struct {
+	mu      sync.Mutex
+	conns   []*streamconn
+	dialing chan struct{} // dialing is closed when the reserved dial ends
+	closed  bool
+}
+
+// exchange q through a pooled connection, dialing one by dial if needed.
+// The query is retried once on a fresh connection if the old one broke.
+func (p *streampool) exchange(
+	ctx context.Context, c *PoolConfig, dial func(context.Context) (net.Conn, error), q []byte,
+) ([]byte, error) {
+	var err error
+	for i := 0; i < 2; i++ {
+		var sc *streamconn
+		sc, err = p.get(ctx, c, dial)
+		if err != nil {
+			return nil, err
+		}
+		var resp []byte
+		resp, err = sc.exchange(ctx, c, q)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil || !sc.broken() {
+			return nil, err
+		}
+		logrus.Debugln("[terasu.dns] -- pooled conn broken, retry err:", err)
+	}
+	return nil, err
+}
+
+// get the least loaded connection or dial a new one by ctx.
+// Only one dial runs at a time so that a burst opens one connection,
+// and it runs unlocked so that the pool serves others meanwhile.
+func (p *streampool) get(
+	ctx context.Context, c *PoolConfig, dial func(context.Context) (net.Conn, error),
+) (*streamconn, error) {
+	var dialing chan struct{}
+	for dialing == nil {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		best, bestn := p.leastloaded()
+		if best != nil && (bestn < c.MaxInflight || len(p.conns) >= c.MaxConns || p.dialing != nil) {
+			p.mu.Unlock()
+			return best, nil
+		}
+		if wait := p.dialing; wait != nil {
+			p.mu.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		dialing = make(chan struct{})
+		p.dialing = dialing
+		p.mu.Unlock()
+	}
+	conn, err := dial(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing = nil
+	close(dialing)
+	if err == nil && p.closed {
+		_ = conn.Close()
+		return nil, ErrPoolClosed
+	}
+	if err != nil {
+		if best, _ := p.leastloaded(); best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	sc := &streamconn{
+		conn:    conn,
+		pool:    p,
+		pending: map[uint16]chan []byte{},
+		done:    make(chan struct{}),
+	}
+	p.conns = append(p.conns, sc)
+	go sc.readloop()
+	return sc, nil
+}
+
+// leastloaded no lock, use under lock
+func (p *streampool) leastloaded() (best *streamconn, bestn int) {
+	for _, sc := range p.conns {
+		n := sc.inflight()
+		if best == nil || n < bestn {
+			best, bestn = sc, n
+		}
+	}
+	return
+}
+
+func (p *streampool) remove(sc *streamconn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, c := range p.conns {
+		if c == sc {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// close all connections and refuse new ones
+func (p *streampool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.reset()
+}
+
+// reset closes all connections, new ones will be dialed on demand
+func (p *streampool) reset() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+	for _, sc := range conns {
+		sc.fail(ErrPoolClosed)
+	}
+}
+
+// streamconn pipelines queries on one connection by message id
+type streamconn struct {
+	conn    net.Conn
+	pool    *streampool
+	wmu     sync.Mutex // wmu serializes writes
+	mu      sync.Mutex
+	pending map[uint16]chan []byte
+	idle    *time.Timer
+	err     error
+	done    chan struct{} // done is closed when broken
+}
+
+func (sc *streamconn) inflight() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.pending)
+}
+
+func (sc *streamconn) broken() bool {
+	select {
+	case <-sc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sc *streamconn) exchange(ctx context.Context, c *PoolConfig, q []byte) ([]byte, error) {
+	if len(q) < 12 {
+		return nil, ErrInvalidResponse
+	}
+	ch := make(chan []byte, 1)
+	id, err := sc.register(ch)
+	if err != nil {
+		return nil, err
+	}
+	defer sc.unregister(id, c.IdleTimeout)
+
+	msg := make([]byte, 2+len(q))
+	binary.BigEndian.PutUint16(msg, uint16(len(q)))
+	copy(msg[2:], q)
+	binary.BigEndian.PutUint16(msg[2:], id)
+	sc.wmu.Lock()
+	_ = sc.conn.SetWriteDeadline(time.Now().Add(dnsDialer.Timeout))
+	_, err = sc.conn.Write(msg)
+	sc.wmu.Unlock()
+	if err != nil {
+		sc.fail(err)
+		return nil, err
+	}
+
+	select {
+	case resp := <-ch:
+		// restore the id of the caller
+		copy(resp[:2], q[:2])
+		return resp, nil
+	case <-sc.done:
+		return nil, sc.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// register a random unused id for ch
+func (sc *streamconn) register(ch chan []byte) (uint16, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.err != nil {
+		return 0, sc.err
+	}
+	if len(sc.pending) >= 0xffff {
+		return 0, ErrTooManyInflight
+	}
+	if sc.idle != nil {
+		sc.idle.Stop()
+		sc.idle = nil
+	}
+	for {
+		id := uint16(rand.Intn(0x10000))
+		if _, ok := sc.pending[id]; !ok {
+			sc.pending[id] = ch
+			return id, nil
+		}
+	}
+}
+
+func (sc *streamconn) unregister(id uint16, idle time.Duration) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	delete(sc.pending, id)
+	if len(sc.pending) == 0 && sc.err == nil && sc.idle == nil {
+		sc.idle = time.AfterFunc(idle, sc.closeidle)
+	}
+}
+
+func (sc *streamconn) closeidle() {
+	sc.mu.Lock()
+	idle := len(sc.pending) == 0
+	sc.mu.Unlock()
+	if idle {
+		sc.fail(ErrConnIdle)
+	}
+}
+
+// readloop dispatches responses, which may come out of order
+func (sc *streamconn) readloop() {
+	for {
+		msg, err := readstreammsg(sc.conn)
+		if err != nil {
+			sc.fail(err)
+			return
+		}
+		if len(msg) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(msg)
+		sc.mu.Lock()
+		ch := sc.pending[id]
+		delete(sc.pending, id)
+		sc.mu.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+// fail marks sc broken, closes it and wakes up all waiters
+func (sc *streamconn) fail(err error) {
+	sc.mu.Lock()
+	if sc.err != nil {
+		sc.mu.Unlock()
+		return
+	}
+	sc.err = err
+	if sc.idle != nil {
+		sc.idle.Stop()
+		sc.idle = nil
+	}
+	close(sc.done)
+	sc.mu.Unlock()
+	_ = sc.conn.Close()
+	sc.pool.remove(sc)
+}
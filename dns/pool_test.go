@@ -0,0 +1,220 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startfakednstcp serves queries on tcp and returns its addr. It reads
+// batch queries before answering them in reverse order, and closes the
+// connection after each batch if oneshot.
+func startfakednstcp(t *testing.T, batch int, oneshot bool, accepts *atomic.Int32) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = lis.Close() })
+	answer := func(q dnsmessage.Question, b *dnsmessage.Builder) error {
+		a := "192.0.2.1"
+		if q.Name.String() == "two.terasu.test." {
+			a = "192.0.2.2"
+		}
+		return fakeanswer(a, "")(q, b)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepts.Add(1)
+			go func() {
+				defer conn.Close()
+				for {
+					qs := make([][]byte, 0, batch)
+					for len(qs) < batch {
+						q, err := readstreammsg(conn)
+						if err != nil {
+							return
+						}
+						qs = append(qs, q)
+					}
+					for i := len(qs) - 1; i >= 0; i-- {
+						resp, err := fakeresponse(qs[i], answer)
+						if err != nil {
+							return
+						}
+						var l [2]byte
+						binary.BigEndian.PutUint16(l[:], uint16(len(resp)))
+						_, _ = conn.Write(append(l[:], resp...))
+					}
+					if oneshot {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func tcpracer(t *testing.T, addr string) racer {
+	stat, err := newdnsstat("tcp://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return racer{host: "local", addr: stat}
+}
+
+func firsta(t *testing.T, msg []byte) (uint16, string) {
+	jr, err := parseresponse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jr.Answer) == 0 {
+		t.Fatal("no answer")
+	}
+	return binary.BigEndian.Uint16(msg), jr.Answer[0].Data
+}
+
+func TestPoolPipelining(t *testing.T) {
+	accepts := atomic.Int32{}
+	r := tcpracer(t, startfakednstcp(t, 2, false, &accepts))
+	defer r.addr.pool.close()
+	s := &serverset{}
+	for round := 0; round < 2; round++ {
+		wg := sync.WaitGroup{}
+		for i, tc := range []struct{ name, want string }{
+			{"one.terasu.test", "192.0.2.1"}, {"two.terasu.test", "192.0.2.2"},
+		} {
+			wg.Add(1)
+			go func(id uint16, name, want string) {
+				defer wg.Done()
+				q, err := newquery(id, name, dnsmessage.TypeA)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp, err := r.exchange(context.Background(), q, s)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				gotid, a := firsta(t, resp)
+				if gotid != id || a != want {
+					t.Error("unexpected", gotid, a, "want", id, want)
+				}
+			}(uint16(1000+i), tc.name, tc.want)
+		}
+		wg.Wait()
+	}
+	if n := accepts.Load(); n != 1 {
+		t.Fatal("expected one pipelined conn but got", n)
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	accepts := atomic.Int32{}
+	r := tcpracer(t, startfakednstcp(t, 1, true, &accepts))
+	defer r.addr.pool.close()
+	s := &serverset{pool: PoolConfig{IdleTimeout: time.Millisecond * 50}}
+	q, err := newquery(7, "one.terasu.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		resp, err := r.exchange(context.Background(), q, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, a := firsta(t, resp); id != 7 || a != "192.0.2.1" {
+			t.Fatal("unexpected", id, a)
+		}
+	}
+	if n := accepts.Load(); n < 3 {
+		t.Fatal("expected reconnects but got", n)
+	}
+
+	r = tcpracer(t, startfakednstcp(t, 1, false, &accepts))
+	defer r.addr.pool.close()
+	_, err = r.exchange(context.Background(), q, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+	r.addr.pool.mu.Lock()
+	n := len(r.addr.pool.conns)
+	r.addr.pool.mu.Unlock()
+	if n != 0 {
+		t.Fatal("idle conn not closed")
+	}
+}
+
+func TestPipeConn(t *testing.T) {
+	accepts := atomic.Int32{}
+	addr := startfakednstcp(t, 1, false, &accepts)
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"local": {"tcp://" + addr}}})
+	defer ds.Close()
+	resolver := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return ds.pipe(ctx), nil
+		},
+	}
+	addrs, err := resolver.LookupIPAddr(context.Background(), "two.terasu.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0].IP.String() != "192.0.2.2" {
+		t.Fatal("unexpected", addrs)
+	}
+	if n := accepts.Load(); n != 1 {
+		t.Fatal("expected one pooled conn but got", n)
+	}
+}
+
+func TestPoolDialUnlocked(t *testing.T) {
+	p := streampool{}
+	c := PoolConfig{}.withdefaults()
+	started := make(chan struct{})
+	dial := func(ctx context.Context) (net.Conn, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := p.get(ctx, &c, dial)
+		done <- err
+	}()
+	<-started
+	// a burst waits for the reserved dial or its own ctx
+	wctx, wcancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer wcancel()
+	if _, err := p.get(wctx, &c, dial); err != context.DeadlineExceeded {
+		t.Fatal("unexpected", err)
+	}
+	p.close()
+	// the dial follows the ctx of its caller
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("unexpected", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("dial ignored the ctx of the caller")
+	}
+	if _, err := p.get(context.Background(), &c, dial); err != ErrPoolClosed {
+		t.Fatal("unexpected", err)
+	}
+}
@@ -0,0 +1,129 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRaceStagger is used when SetRace is called with stagger 0
+const DefaultRaceStagger = time.Millisecond * 100
+
+type racer struct {
+	host string // host is the SNI of the server
+	addr *dnsstat
+}
+
+type raceresult struct {
+	racer
+	addrs   []string
+	err     error
+	latency time.Duration
+}
+
+// SetRace enables racing the top n enabled servers, both DoT and DoH,
+// starting one after another every stagger. The first valid answer wins
+// and the rest are canceled. n <= 0 restores sequential iteration.
+func (ds *DNSList) SetRace(n int, stagger time.Duration) {
+	if stagger <= 0 {
+		stagger = DefaultRaceStagger
+	}
+	ds.update(func(s *serverset) {
+		s.race = n
+		s.stagger = stagger
+	})
+}
+
+func (ds *DNSList) racing() bool {
+	return ds.load().race > 0
+}
+
+// racers picks the top n enabled servers
+func (s *serverset) racers(n int) []racer {
+	rs := s.ranked()
+	if len(rs) > n {
+		rs = rs[:n]
+	}
+	return rs
+}
+
+func (ds *DNSList) lookupHostRace(ctx context.Context, host string) ([]string, error) {
+	s := ds.load()
+	rs := s.racers(s.race)
+	cfg := s.health.withdefaults()
+	fallbacks := s.b[host]
+
+	ctx, cancel := context.WithCancel(withbootstrap(ctx, ds))
+	defer cancel()
+
+	ch := make(chan raceresult, len(rs))
+	for i, r := range rs {
+		go func(i int, r racer) {
+			if i > 0 {
+				t := time.NewTimer(s.stagger * time.Duration(i))
+				select {
+				case <-ctx.Done():
+					t.Stop()
+					ch <- raceresult{racer: r, err: ctx.Err()}
+					return
+				case <-t.C:
+				}
+			}
+			logrus.Debugln("[terasu.dns] -> race", r.host, r.addr)
+			start := time.Now()
+			addrs, err := r.lookup(ctx, host, s)
+			ch <- raceresult{racer: r, addrs: addrs, err: err, latency: time.Since(start)}
+		}(i, r)
+	}
+	for range rs {
+		res := <-ch
+		if res.err == nil {
+			res.addr.succeeded(&cfg, res.latency)
+			if len(res.addrs) > 0 {
+				logrus.Debugln("[terasu.dns] <- race", res.host, res.addr, "won")
+				return res.addrs, nil
+			}
+			continue
+		}
+		if ctx.Err() == nil { // the losers are canceled by us
+			res.addr.failed(&cfg, res.err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(fallbacks) > 0 {
+		return fallbacks, nil
+	}
+	if addrs := diskCache.get(host); len(addrs) > 0 {
+		return addrs, nil
+	}
+	return nil, ErrNoDNSAvailable
+}
+
+// lookup host through this single server
+func (r *racer) lookup(ctx context.Context, host string, s *serverset) ([]string, error) {
+	if r.addr.ishttps() {
+		jr, err := lookupdoh(ctx, r.addr.up, host)
+		if err != nil {
+			return nil, err
+		}
+		hosts := jr.hosts()
+		err = s.poison.check(hosts)
+		if err != nil {
+			return nil, err
+		}
+		return hosts, nil
+	}
+	resolver := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return newpipeconn(ctx, func(ctx context.Context, q []byte) ([]byte, error) {
+				return r.exchange(ctx, q, s)
+			}), nil
+		},
+	}
+	return resolver.LookupHost(ctx, host)
+}
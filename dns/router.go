@@ -0,0 +1,143 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// RouteUnlisted is the pattern of names under top level domains that are
+// not in the public suffix list, such as corp, lan or internal
+const RouteUnlisted = "!unlisted"
+
+var (
+	// ErrInvalidRoute is reported on empty patterns or groups
+	ErrInvalidRoute = errors.New("invalid route")
+	// ErrUnknownGroup is reported when a name is routed to a group never set
+	ErrUnknownGroup = errors.New("unknown group")
+)
+
+// Router routes names to named groups of servers by domain suffix.
+// A pattern like corp, .corp or *.corp matches corp and all names
+// under it, and the longest matching pattern wins. Names matching
+// nothing go to the default group, or to the built-in servers if
+// the default group is not set. Names routed to a group that does not
+// exist are refused rather than leaked to the built-in servers.
+type Router struct {
+	mu     sync.RWMutex
+	groups map[string]*DNSList
+	rules  map[string]string // rules map[suffix]group
+	def    string
+}
+
+// DefaultRouter is used by LookupHost and DefaultResolver
+var DefaultRouter Router
+
+// SetGroup adds or replaces the group name, nil ds deletes it
+func (rt *Router) SetGroup(name string, ds *DNSList) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if ds == nil {
+		delete(rt.groups, name)
+		return
+	}
+	if rt.groups == nil {
+		rt.groups = map[string]*DNSList{}
+	}
+	rt.groups[name] = ds
+}
+
+// Route names matching pattern to group
+func (rt *Router) Route(pattern, group string) error {
+	pattern = routepattern(pattern)
+	if pattern == "" || group == "" {
+		return ErrInvalidRoute
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.rules == nil {
+		rt.rules = map[string]string{}
+	}
+	rt.rules[pattern] = group
+	return nil
+}
+
+// Unroute removes the rule of pattern
+func (rt *Router) Unroute(pattern string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	delete(rt.rules, routepattern(pattern))
+}
+
+// SetDefault sets the group of names matching no rule
+func (rt *Router) SetDefault(group string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.def = group
+}
+
+func routepattern(pattern string) string {
+	if pattern == RouteUnlisted {
+		return pattern
+	}
+	pattern = strings.TrimPrefix(normname(pattern), "*")
+	return strings.TrimPrefix(pattern, ".")
+}
+
+// Group tells the group name of name, which is empty for the built-in servers
+func (rt *Router) Group(name string) string {
+	name = normname(name)
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	if len(rt.rules) > 0 {
+		for s := name; s != ""; {
+			if g, ok := rt.rules[s]; ok {
+				return g
+			}
+			i := strings.IndexByte(s, '.')
+			if i < 0 {
+				break
+			}
+			s = s[i+1:]
+		}
+		if g, ok := rt.rules[RouteUnlisted]; ok && unlisted(name) {
+			return g
+		}
+	}
+	return rt.def
+}
+
+// Pick the servers of name
+func (rt *Router) Pick(name string) (*DNSList, error) {
+	g := rt.Group(name)
+	if g == "" {
+		return defaultServers(), nil
+	}
+	rt.mu.RLock()
+	ds := rt.groups[g]
+	rt.mu.RUnlock()
+	if ds == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownGroup, g)
+	}
+	return ds, nil
+}
+
+// unlisted tells whether the top level domain of name is unknown to the
+// public suffix list, whose implicit * rule makes it a non icann suffix
+func unlisted(name string) bool {
+	suffix, icann := publicsuffix.PublicSuffix(name)
+	return !icann && !strings.Contains(suffix, ".")
+}
+
+// exchange q with the group of its question name
+func (rt *Router) exchange(ctx context.Context, q []byte) ([]byte, error) {
+	ds, err := rt.Pick(questionname(q))
+	if err != nil {
+		return nil, err
+	}
+	return ds.exchange(ctx, q)
+}
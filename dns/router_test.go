@@ -0,0 +1,65 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRouterGroup(t *testing.T) {
+	rt := Router{}
+	for pattern, group := range map[string]string{
+		"*.corp": "local", "example.cn": "domestic", ".cn": "domestic2", RouteUnlisted: "unlisted",
+	} {
+		if err := rt.Route(pattern, group); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rt.Route("", "x") == nil {
+		t.Fatal("expected error")
+	}
+	rt.SetDefault("evasive")
+	for name, want := range map[string]string{
+		"git.corp":           "local",
+		"corp":               "local",
+		"www.example.cn":     "domestic",
+		"www.example.com.cn": "domestic2",
+		"nas.lan":            "unlisted",
+		"www.google.com":     "evasive",
+		"user.github.io":     "evasive",
+	} {
+		if got := rt.Group(name); got != want {
+			t.Fatal(name, "expected", want, "but got", got)
+		}
+	}
+	rt.Unroute(".corp")
+	if got := rt.Group("git.corp"); got != "unlisted" {
+		t.Fatal("unexpected", got)
+	}
+	if ds, err := rt.Pick("git.corp"); ds != nil || !errors.Is(err, ErrUnknownGroup) {
+		t.Fatal("missing group should be refused but got", ds, err)
+	}
+	rt.SetDefault("")
+	if ds, err := rt.Pick("www.google.com"); ds != defaultServers() || err != nil {
+		t.Fatal("unrouted name should use the built-in servers but got", ds, err)
+	}
+}
+
+func TestRouterExchange(t *testing.T) {
+	local := DNSList{}
+	local.Add(&DNSConfig{Servers: map[string][]string{"local": {"udp://" + startfakedns(t, fakeanswer("192.0.2.7", ""))}}})
+	rt := Router{}
+	rt.SetGroup("local", &local)
+	_ = rt.Route(".corp", "local")
+	q, err := newquery(1, "git.corp", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := rt.exchange(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs := answeraddrs(resp); len(addrs) != 1 || addrs[0] != "192.0.2.7" {
+		t.Fatal("unexpected", addrs)
+	}
+}
@@ -0,0 +1,548 @@
+package dns
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// record types unknown to dnsmessage (RFC 4034, 5155, 6672)
+const (
+	typeDNAME  = 39
+	typeDS     = 43
+	typeRRSIG  = 46
+	typeNSEC   = 47
+	typeDNSKEY = 48
+	typeNSEC3  = 50
+)
+
+// DNSSEC algorithms (RFC 8624)
+const (
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+)
+
+// DS digest types
+const (
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+var (
+	errMalformedRR  = errors.New("malformed dnssec record")
+	errUnsupported  = errors.New("unsupported dnssec algorithm")
+	errBadSignature = errors.New("bad signature")
+)
+
+// rr is a record in canonical form (RFC 4034 6.2)
+type rr struct {
+	name  string
+	typ   uint16
+	class uint16
+	data  []byte
+}
+
+// rrsig is the rdata of an RRSIG (RFC 4034 3.1)
+type rrsig struct {
+	covered    uint16
+	alg        uint8
+	labels     uint8
+	origttl    uint32
+	expiration uint32
+	inception  uint32
+	keytag     uint16
+	signer     string
+	sig        []byte
+	signed     []byte // signed is the rdata before the signature with the signer in canonical form
+	ttl        uint32
+}
+
+// rrset are the records of the same name and type, with their signatures
+type rrset struct {
+	name string
+	typ  uint16
+	rrs  []rr
+	sigs []*rrsig
+	ttl  uint32 // ttl is the min ttl of the records
+}
+
+// dnssecmsg is a parsed response grouped into rrsets
+type dnssecmsg struct {
+	rcode     dnsmessage.RCode
+	qname     string
+	qtype     uint16
+	answer    []*rrset
+	authority []*rrset
+}
+
+// asciilower lowercases only A-Z as names may carry any byte
+func asciilower(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 'A' && c <= 'Z' {
+			b := []byte(s)
+			for j := i; j < len(b); j++ {
+				if b[j] >= 'A' && b[j] <= 'Z' {
+					b[j] += 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return s
+}
+
+// canonname is the lowercase name with the trailing dot
+func canonname(name string) string {
+	name = asciilower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// labels of a canonical name from the root, empty for the root
+func labels(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// parentname is the name without its first label
+func parentname(name string) string {
+	i := strings.IndexByte(name, '.')
+	if i < 0 || i == len(name)-1 {
+		return "."
+	}
+	return name[i+1:]
+}
+
+// issubdomain tells whether name is zone or below it
+func issubdomain(name, zone string) bool {
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// appendname appends the uncompressed wire form of a canonical name
+func appendname(b []byte, name string) []byte {
+	for _, l := range labels(name) {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// readname reads an uncompressed name at off of b
+func readname(b []byte, off int) (string, int, error) {
+	sb := strings.Builder{}
+	for {
+		if off >= len(b) {
+			return "", 0, errMalformedRR
+		}
+		n := int(b[off])
+		off++
+		if n == 0 {
+			break
+		}
+		if n > 63 || off+n > len(b) {
+			return "", 0, errMalformedRR
+		}
+		sb.Write(b[off : off+n])
+		sb.WriteByte('.')
+		off += n
+	}
+	if sb.Len() == 0 {
+		return ".", off, nil
+	}
+	return asciilower(sb.String()), off, nil
+}
+
+// compareNames in the canonical order of RFC 4034 6.1
+func compareNames(a, b string) int {
+	la, lb := labels(a), labels(b)
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// canonrdata is the rdata of body with names uncompressed in lowercase
+func canonrdata(body dnsmessage.ResourceBody) ([]byte, bool) {
+	var b []byte
+	switch r := body.(type) {
+	case *dnsmessage.AResource:
+		b = append(b, r.A[:]...)
+	case *dnsmessage.AAAAResource:
+		b = append(b, r.AAAA[:]...)
+	case *dnsmessage.CNAMEResource:
+		b = appendname(b, canonname(r.CNAME.String()))
+	case *dnsmessage.NSResource:
+		b = appendname(b, canonname(r.NS.String()))
+	case *dnsmessage.PTRResource:
+		b = appendname(b, canonname(r.PTR.String()))
+	case *dnsmessage.MXResource:
+		b = binary.BigEndian.AppendUint16(b, r.Pref)
+		b = appendname(b, canonname(r.MX.String()))
+	case *dnsmessage.SOAResource:
+		b = appendname(b, canonname(r.NS.String()))
+		b = appendname(b, canonname(r.MBox.String()))
+		for _, v := range []uint32{r.Serial, r.Refresh, r.Retry, r.Expire, r.MinTTL} {
+			b = binary.BigEndian.AppendUint32(b, v)
+		}
+	case *dnsmessage.SRVResource:
+		for _, v := range []uint16{r.Priority, r.Weight, r.Port} {
+			b = binary.BigEndian.AppendUint16(b, v)
+		}
+		b = appendname(b, canonname(r.Target.String()))
+	case *dnsmessage.TXTResource:
+		for _, s := range r.TXT {
+			b = append(b, byte(len(s)))
+			b = append(b, s...)
+		}
+	case *dnsmessage.UnknownResource:
+		b = append(b, r.Data...)
+	default:
+		return nil, false
+	}
+	return b, true
+}
+
+// parserrsig parses the rdata of an RRSIG
+func parserrsig(data []byte) (*rrsig, error) {
+	if len(data) < 18 {
+		return nil, errMalformedRR
+	}
+	sig := &rrsig{
+		covered:    binary.BigEndian.Uint16(data),
+		alg:        data[2],
+		labels:     data[3],
+		origttl:    binary.BigEndian.Uint32(data[4:]),
+		expiration: binary.BigEndian.Uint32(data[8:]),
+		inception:  binary.BigEndian.Uint32(data[12:]),
+		keytag:     binary.BigEndian.Uint16(data[16:]),
+	}
+	signer, off, err := readname(data, 18)
+	if err != nil {
+		return nil, err
+	}
+	sig.signer = signer
+	sig.sig = data[off:]
+	sig.signed = appendname(append([]byte(nil), data[:18]...), signer)
+	return sig, nil
+}
+
+// parsednssec groups the answer and authority of msg into rrsets
+func parsednssec(msg []byte) (*dnssecmsg, error) {
+	var m dnsmessage.Message
+	err := m.Unpack(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Questions) != 1 {
+		return nil, errMalformedRR
+	}
+	dm := &dnssecmsg{
+		rcode: m.RCode,
+		qname: canonname(m.Questions[0].Name.String()),
+		qtype: uint16(m.Questions[0].Type),
+	}
+	dm.answer, err = grouprrsets(m.Answers)
+	if err != nil {
+		return nil, err
+	}
+	dm.authority, err = grouprrsets(m.Authorities)
+	if err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
+
+func grouprrsets(rs []dnsmessage.Resource) ([]*rrset, error) {
+	type key struct {
+		name string
+		typ  uint16
+	}
+	var sets []*rrset
+	m := map[key]*rrset{}
+	get := func(k key) *rrset {
+		set, ok := m[k]
+		if !ok {
+			set = &rrset{name: k.name, typ: k.typ}
+			m[k] = set
+			sets = append(sets, set)
+		}
+		return set
+	}
+	for _, r := range rs {
+		name := canonname(r.Header.Name.String())
+		if r.Header.Type == typeRRSIG {
+			u, ok := r.Body.(*dnsmessage.UnknownResource)
+			if !ok {
+				return nil, errMalformedRR
+			}
+			sig, err := parserrsig(u.Data)
+			if err != nil {
+				return nil, err
+			}
+			sig.ttl = r.Header.TTL
+			set := get(key{name, sig.covered})
+			set.sigs = append(set.sigs, sig)
+			continue
+		}
+		data, ok := canonrdata(r.Body)
+		if !ok {
+			continue
+		}
+		set := get(key{name, uint16(r.Header.Type)})
+		if len(set.rrs) == 0 || r.Header.TTL < set.ttl {
+			set.ttl = r.Header.TTL
+		}
+		set.rrs = append(set.rrs, rr{name: name, typ: uint16(r.Header.Type), class: uint16(r.Header.Class), data: data})
+	}
+	// rrsets with only signatures are not answers
+	n := 0
+	for _, set := range sets {
+		if len(set.rrs) > 0 {
+			sets[n] = set
+			n++
+		}
+	}
+	return sets[:n], nil
+}
+
+// dnskey is the rdata of a DNSKEY (RFC 4034 2.1)
+type dnskey struct {
+	flags  uint16
+	alg    uint8
+	pubkey []byte
+	rdata  []byte
+	keytag uint16
+}
+
+func parsednskey(data []byte) (*dnskey, error) {
+	if len(data) < 4 || data[2] != 3 {
+		return nil, errMalformedRR
+	}
+	return &dnskey{
+		flags:  binary.BigEndian.Uint16(data),
+		alg:    data[3],
+		pubkey: data[4:],
+		rdata:  data,
+		keytag: keytag(data),
+	}, nil
+}
+
+// iszonekey tells whether the zone key flag is set
+func (k *dnskey) iszonekey() bool {
+	return k.flags&0x0100 != 0
+}
+
+// keytag of a DNSKEY rdata (RFC 4034 appendix B)
+func keytag(rdata []byte) uint16 {
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 0 {
+			ac += uint32(b) << 8
+		} else {
+			ac += uint32(b)
+		}
+	}
+	ac += ac >> 16 & 0xffff
+	return uint16(ac)
+}
+
+// dsrecord is the rdata of a DS (RFC 4034 5.1)
+type dsrecord struct {
+	keytag     uint16
+	alg        uint8
+	digesttype uint8
+	digest     []byte
+}
+
+func parseds(data []byte) (*dsrecord, error) {
+	if len(data) < 5 {
+		return nil, errMalformedRR
+	}
+	return &dsrecord{
+		keytag:     binary.BigEndian.Uint16(data),
+		alg:        data[2],
+		digesttype: data[3],
+		digest:     data[4:],
+	}, nil
+}
+
+// matches tells whether the key of owner is the one of ds
+func (ds *dsrecord) matches(owner string, k *dnskey) bool {
+	if ds.keytag != k.keytag || ds.alg != k.alg {
+		return false
+	}
+	var h hash.Hash
+	switch ds.digesttype {
+	case digestSHA1:
+		h = sha1.New()
+	case digestSHA256:
+		h = sha256.New()
+	case digestSHA384:
+		h = sha512.New384()
+	default:
+		return false
+	}
+	h.Write(appendname(nil, owner))
+	h.Write(k.rdata)
+	return bytes.Equal(h.Sum(nil), ds.digest)
+}
+
+// supported tells whether the algorithm can be validated
+func supported(alg uint8) bool {
+	switch alg {
+	case algRSASHA256, algRSASHA512, algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+		return true
+	}
+	return false
+}
+
+// validperiod tells whether now is between inception and expiration
+// in serial number arithmetic (RFC 4034 3.1.5)
+func (sig *rrsig) validperiod(now time.Time) bool {
+	t := uint32(now.Unix())
+	return int32(t-sig.inception) >= 0 && int32(sig.expiration-t) >= 0
+}
+
+// signeddata builds the data covered by sig over set (RFC 4035 5.3.2)
+func (sig *rrsig) signeddata(set *rrset) []byte {
+	owner := set.name
+	if l := labels(owner); len(l) > int(sig.labels) {
+		// expanded from a wildcard
+		owner = "*." + strings.Join(l[len(l)-int(sig.labels):], ".") + "."
+	}
+	datas := make([][]byte, 0, len(set.rrs))
+	for _, r := range set.rrs {
+		datas = append(datas, r.data)
+	}
+	sort.Slice(datas, func(i, j int) bool { return bytes.Compare(datas[i], datas[j]) < 0 })
+	b := append([]byte(nil), sig.signed...)
+	var prev []byte
+	for i, d := range datas {
+		if i > 0 && bytes.Equal(d, prev) {
+			continue // duplicated records are signed once
+		}
+		prev = d
+		b = appendname(b, owner)
+		b = binary.BigEndian.AppendUint16(b, set.typ)
+		b = binary.BigEndian.AppendUint16(b, set.rrs[0].class)
+		b = binary.BigEndian.AppendUint32(b, sig.origttl)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(d)))
+		b = append(b, d...)
+	}
+	return b
+}
+
+// verify sig over set by key
+func (sig *rrsig) verify(set *rrset, key *dnskey) error {
+	if sig.alg != key.alg || sig.keytag != key.keytag || !key.iszonekey() {
+		return errBadSignature
+	}
+	data := sig.signeddata(set)
+	switch sig.alg {
+	case algRSASHA256, algRSASHA512:
+		pub, err := rsapubkey(key.pubkey)
+		if err != nil {
+			return err
+		}
+		h, hh := crypto.SHA256, sha256.New()
+		if sig.alg == algRSASHA512 {
+			h, hh = crypto.SHA512, sha512.New()
+		}
+		hh.Write(data)
+		return rsa.VerifyPKCS1v15(pub, h, hh.Sum(nil), sig.sig)
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, size, hh := elliptic.P256(), 32, sha256.New()
+		if sig.alg == algECDSAP384SHA384 {
+			curve, size, hh = elliptic.P384(), 48, sha512.New384()
+		}
+		if len(key.pubkey) != 2*size || len(sig.sig) != 2*size {
+			return errMalformedRR
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.pubkey[:size]),
+			Y:     new(big.Int).SetBytes(key.pubkey[size:]),
+		}
+		hh.Write(data)
+		r := new(big.Int).SetBytes(sig.sig[:size])
+		s := new(big.Int).SetBytes(sig.sig[size:])
+		if !ecdsa.Verify(pub, hh.Sum(nil), r, s) {
+			return errBadSignature
+		}
+		return nil
+	case algED25519:
+		if len(key.pubkey) != ed25519.PublicKeySize {
+			return errMalformedRR
+		}
+		if !ed25519.Verify(key.pubkey, data, sig.sig) {
+			return errBadSignature
+		}
+		return nil
+	}
+	return errUnsupported
+}
+
+// rsapubkey parses an RSA key of RFC 3110 2
+func rsapubkey(b []byte) (*rsa.PublicKey, error) {
+	if len(b) < 3 {
+		return nil, errMalformedRR
+	}
+	n, off := int(b[0]), 1
+	if n == 0 {
+		n, off = int(binary.BigEndian.Uint16(b[1:])), 3
+	}
+	if n == 0 || n > 8 || off+n >= len(b) {
+		return nil, errMalformedRR
+	}
+	e := 0
+	for _, c := range b[off : off+n] {
+		e = e<<8 | int(c)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(b[off+n:]), E: e}, nil
+}
+
+// verifyset tells whether any valid signature of set by signer is made by keys
+func verifyset(set *rrset, signer string, keys []*dnskey, now time.Time) bool {
+	return verifysig(set, signer, keys, now) != nil
+}
+
+// verifysig is the first valid signature of set by signer made by keys
+func verifysig(set *rrset, signer string, keys []*dnskey, now time.Time) *rrsig {
+	for _, sig := range set.sigs {
+		if sig.signer != signer || !sig.validperiod(now) || int(sig.labels) > len(labels(set.name)) {
+			continue
+		}
+		for _, k := range keys {
+			if sig.verify(set, k) == nil {
+				return sig
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,696 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DefaultServerAddr is the listening address of Server if not set
+const DefaultServerAddr = "127.0.0.53:53"
+
+const (
+	// negativeTTL caches answers without records such as NXDOMAIN
+	negativeTTL = 60
+	// maxCacheTTL caps the cache time of any answer
+	maxCacheTTL = 3600
+	// tcpIdleTimeout closes idle client connections (RFC 7766 6.2.3)
+	tcpIdleTimeout = time.Second * 10
+	// minUDPSize is the payload size of clients without EDNS(0)
+	minUDPSize = 512
+)
+
+var (
+	// ErrServerClosed is returned by Serve after Close
+	ErrServerClosed = errors.New("dns server closed")
+	// ErrUnsupportedQuery is reported when a json DoH server cannot answer the type
+	ErrUnsupportedQuery = errors.New("unsupported query")
+)
+
+// wireentry is a cached response with the time it was stored
+type wireentry struct {
+	msg    []byte
+	stored time.Time
+	ttl    uint32
+}
+
+// maxUDPQueries bounds the udp queries answered at once
+const maxUDPQueries = 256
+
+// Server is a local DNS server on both UDP and TCP. It answers A and
+// AAAA queries of overridden names itself and forwards everything else
+// in wire format to the group of the name, caching the responses apart
+// from other Servers. The cache is purged along with HostCache.
+type Server struct {
+	// Addr is the listening address, DefaultServerAddr if empty
+	Addr string
+	// Router routes the queries, DefaultRouter if nil
+	Router *Router
+	// Overrides are answered directly, HostOverrides if nil
+	Overrides *Overrides
+	// Timeout of each query, 5s if 0
+	Timeout time.Duration
+	// DNS64 synthesizes AAAA answers, DefaultDNS64 if nil
+	DNS64 *DNS64
+
+	mu     sync.Mutex
+	pc     net.PacketConn
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	cache  Cache // cache holds *wireentry by queryinfo.cachekey
+}
+
+func (srv *Server) router() *Router {
+	if srv.Router == nil {
+		return &DefaultRouter
+	}
+	return srv.Router
+}
+
+func (srv *Server) overrides() *Overrides {
+	if srv.Overrides == nil {
+		return &HostOverrides
+	}
+	return srv.Overrides
+}
+
+func (srv *Server) dns64() *DNS64 {
+	if srv.DNS64 == nil {
+		return &DefaultDNS64
+	}
+	return srv.DNS64
+}
+
+func (srv *Server) timeout() time.Duration {
+	if srv.Timeout <= 0 {
+		return time.Second * 5
+	}
+	return srv.Timeout
+}
+
+// ListenAndServe listens on Addr of both UDP and TCP and serves until Close
+func (srv *Server) ListenAndServe() error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = DefaultServerAddr
+	}
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	return srv.Serve(pc, ln)
+}
+
+// Serve queries on pc and ln, any of which can be nil, until Close
+func (srv *Server) Serve(pc net.PacketConn, ln net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.pc, srv.ln = pc, ln
+	srv.mu.Unlock()
+	defer HostCache.link(&srv.cache)()
+	errs := make(chan error, 2)
+	n := 0
+	if pc != nil {
+		n++
+		go func() { errs <- srv.serveudp(pc) }()
+	}
+	if ln != nil {
+		n++
+		go func() { errs <- srv.servetcp(ln) }()
+	}
+	var err error
+	for i := 0; i < n; i++ {
+		if e := <-errs; err == nil {
+			err = e
+			_ = srv.Close()
+		}
+	}
+	return err
+}
+
+// Close stops serving and closes all client connections
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closed {
+		return nil
+	}
+	srv.closed = true
+	if srv.pc != nil {
+		_ = srv.pc.Close()
+	}
+	if srv.ln != nil {
+		_ = srv.ln.Close()
+	}
+	for conn := range srv.conns {
+		_ = conn.Close()
+	}
+	return nil
+}
+
+func (srv *Server) isclosed() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closed
+}
+
+func (srv *Server) serveudp(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	sem := make(chan struct{}, maxUDPQueries)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if srv.isclosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		q := append([]byte(nil), buf[:n]...)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			resp := srv.handle(q)
+			if resp == nil {
+				return
+			}
+			_, _ = pc.WriteTo(truncate(resp, udpsize(q)), addr)
+		}()
+	}
+}
+
+func (srv *Server) servetcp(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isclosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		if srv.conns == nil {
+			srv.conns = map[net.Conn]struct{}{}
+		}
+		srv.conns[conn] = struct{}{}
+		srv.mu.Unlock()
+		go srv.servestream(conn)
+	}
+}
+
+// servestream answers pipelined queries of conn, maybe out of order
+func (srv *Server) servestream(conn net.Conn) {
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		_ = conn.Close()
+	}()
+	wmu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		q, err := readstreammsg(conn)
+		if err != nil {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := srv.handle(q)
+			if resp == nil {
+				return
+			}
+			msg := make([]byte, 2+len(resp))
+			binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+			copy(msg[2:], resp)
+			wmu.Lock()
+			_ = conn.SetWriteDeadline(time.Now().Add(srv.timeout()))
+			_, _ = conn.Write(msg)
+			wmu.Unlock()
+		}()
+	}
+}
+
+// queryinfo is what the server needs from a query
+type queryinfo struct {
+	header   dnsmessage.Header
+	question dnsmessage.Question
+	opt      *dnsmessage.Resource // opt is the EDNS(0) record if any
+}
+
+func parsequery(q []byte) (qi queryinfo, err error) {
+	var p dnsmessage.Parser
+	qi.header, err = p.Start(q)
+	if err != nil {
+		return
+	}
+	qi.question, err = p.Question()
+	if err != nil {
+		return
+	}
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return
+	}
+	err = p.SkipAllAnswers()
+	if err != nil {
+		return
+	}
+	err = p.SkipAllAuthorities()
+	if err != nil {
+		return
+	}
+	for {
+		var h dnsmessage.ResourceHeader
+		h, err = p.AdditionalHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			return qi, nil
+		}
+		if err != nil {
+			return
+		}
+		if h.Type != dnsmessage.TypeOPT {
+			err = p.SkipAdditional()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		var r dnsmessage.OPTResource
+		r, err = p.OPTResource()
+		if err != nil {
+			return
+		}
+		qi.opt = &dnsmessage.Resource{Header: h, Body: &r}
+	}
+}
+
+// udpsize is the max response size the client of q accepts on udp
+func udpsize(q []byte) int {
+	qi, err := parsequery(q)
+	if err != nil || qi.opt == nil || int(qi.opt.Header.Class) < minUDPSize {
+		return minUDPSize
+	}
+	return int(qi.opt.Header.Class)
+}
+
+// dnssecok tells whether the DO bit of the EDNS(0) record is set
+func (qi *queryinfo) dnssecok() bool {
+	return qi.opt != nil && qi.opt.Header.TTL&0x8000 != 0
+}
+
+func (qi *queryinfo) cachekey() string {
+	sb := strings.Builder{}
+	// by the normalised name to be purged along with HostCache
+	sb.WriteString(normname(qi.question.Name.String()))
+	sb.WriteByte(' ')
+	sb.WriteString(qi.question.Type.String())
+	sb.WriteByte(' ')
+	sb.WriteString(qi.question.Class.String())
+	if qi.dnssecok() {
+		sb.WriteString(" do")
+	}
+	if qi.header.CheckingDisabled {
+		sb.WriteString(" cd")
+	}
+	// answers may differ by the client subnet
+	if qi.opt != nil {
+		for _, o := range qi.opt.Body.(*dnsmessage.OPTResource).Options {
+			if o.Code == ecsOptionCode {
+				sb.WriteString(" ecs=")
+				sb.WriteString(hex.EncodeToString(o.Data))
+			}
+		}
+	}
+	return sb.String()
+}
+
+// reply builds a response of qi with rcode and answers
+func (qi *queryinfo) reply(rcode dnsmessage.RCode, answers []dnsmessage.Resource) []byte {
+	m := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID: qi.header.ID, Response: true, OpCode: qi.header.OpCode,
+			RecursionDesired: qi.header.RecursionDesired, RecursionAvailable: true,
+			CheckingDisabled: qi.header.CheckingDisabled, RCode: rcode,
+		},
+		Questions: []dnsmessage.Question{qi.question},
+		Answers:   answers,
+	}
+	if qi.opt != nil {
+		var h dnsmessage.ResourceHeader
+		_ = h.SetEDNS0(ednsPayloadLen, rcode, false)
+		m.Additionals = []dnsmessage.Resource{{Header: h, Body: &dnsmessage.OPTResource{}}}
+	}
+	msg, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// handle q and return the response, nil means no response
+func (srv *Server) handle(q []byte) []byte {
+	qi, err := parsequery(q)
+	if err != nil {
+		if len(q) < 12 || q[2]&0x80 != 0 { // not even a query header
+			return nil
+		}
+		m := dnsmessage.Message{Header: dnsmessage.Header{
+			ID: binary.BigEndian.Uint16(q), Response: true, RCode: dnsmessage.RCodeFormatError,
+		}}
+		msg, _ := m.Pack()
+		return msg
+	}
+	if qi.header.Response {
+		return nil
+	}
+	if qi.header.OpCode != 0 {
+		return qi.reply(dnsmessage.RCodeNotImplemented, nil)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), srv.timeout())
+	defer cancel()
+	if resp, ok := srv.override(ctx, &qi); ok {
+		return resp
+	}
+	key := qi.cachekey()
+	if e, ok := srv.cache.load(key).(*wireentry); ok {
+		if resp := e.fresh(qi.header.ID); resp != nil {
+			return resp
+		}
+	}
+	name := normname(qi.question.Name.String())
+	ds, err := srv.router().Pick(name)
+	if err != nil {
+		logrus.Debugln("[terasu.dns] server refuse", name, "err:", err)
+		return qi.reply(dnsmessage.RCodeRefused, nil)
+	}
+	resp, err := ds.exchangeall(ctx, q)
+	if err != nil {
+		logrus.Debugln("[terasu.dns] server", name, qi.question.Type, "err:", err)
+		return qi.reply(dnsmessage.RCodeServerFailure, nil)
+	}
+	if r := srv.dns64().synthesizemsg(ctx, &qi, ds, resp); r != nil {
+		resp = r
+	}
+	binary.BigEndian.PutUint16(resp, qi.header.ID)
+	if t, ok := cachettl(resp); ok {
+		srv.cache.store(key, &wireentry{msg: resp, stored: time.Now(), ttl: t}, time.Duration(t)*time.Second)
+	}
+	return resp
+}
+
+// override answers A, AAAA and CNAME queries of overridden names
+func (srv *Server) override(ctx context.Context, qi *queryinfo) ([]byte, bool) {
+	if qi.question.Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+	name := normname(qi.question.Name.String())
+	ov, ok := srv.overrides().Lookup(name)
+	if !ok {
+		return nil, false
+	}
+	var answers []dnsmessage.Resource
+	owner := qi.question.Name
+	if ov.Alias != "" {
+		target, err := dnsmessage.NewName(ov.Alias + ".")
+		if err != nil {
+			return qi.reply(dnsmessage.RCodeServerFailure, nil), true
+		}
+		answers = append(answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: owner, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: negativeTTL},
+			Body:   &dnsmessage.CNAMEResource{CNAME: target},
+		})
+		if qi.question.Type == dnsmessage.TypeCNAME {
+			return qi.reply(dnsmessage.RCodeSuccess, answers), true
+		}
+		owner = target
+	}
+	if qi.question.Type != dnsmessage.TypeA && qi.question.Type != dnsmessage.TypeAAAA {
+		return qi.reply(dnsmessage.RCodeSuccess, answers), true
+	}
+	addrs, _, err := srv.overrides().resolve(ctx, name, srv.lookup)
+	if err != nil {
+		return qi.reply(dnsmessage.RCodeServerFailure, nil), true
+	}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		h := dnsmessage.ResourceHeader{Name: owner, Type: qi.question.Type, Class: dnsmessage.ClassINET, TTL: negativeTTL}
+		if ip4 := ip.To4(); ip4 != nil && qi.question.Type == dnsmessage.TypeA {
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip4)
+			answers = append(answers, dnsmessage.Resource{Header: h, Body: r})
+		} else if ip4 == nil && ip != nil && qi.question.Type == dnsmessage.TypeAAAA {
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip)
+			answers = append(answers, dnsmessage.Resource{Header: h, Body: r})
+		}
+	}
+	return qi.reply(dnsmessage.RCodeSuccess, answers), true
+}
+
+// lookup the target of an alias by the router and DNS64 of srv
+func (srv *Server) lookup(ctx context.Context, host string) ([]string, error) {
+	resolver := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return newpipeconn(ctx, srv.router().exchange), nil
+		},
+	}
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return srv.dns64().synthesize(ctx, addrs), nil
+}
+
+// cachettl is the min ttl of the records in resp, or negativeTTL if
+// there is no record. Failures other than NXDOMAIN are not cached.
+func cachettl(resp []byte) (uint32, bool) {
+	var m dnsmessage.Message
+	if m.Unpack(resp) != nil || m.Truncated ||
+		(m.RCode != dnsmessage.RCodeSuccess && m.RCode != dnsmessage.RCodeNameError) {
+		return 0, false
+	}
+	t := uint32(maxCacheTTL)
+	n := 0
+	for _, sec := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for _, r := range sec {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			n++
+			if r.Header.TTL < t {
+				t = r.Header.TTL
+			}
+		}
+	}
+	if n == 0 {
+		t = negativeTTL
+	}
+	return t, t > 0
+}
+
+// fresh is the cached response with id and the ttls decreased
+// by its age, or nil if expired
+func (e *wireentry) fresh(id uint16) []byte {
+	age := uint32(time.Since(e.stored) / time.Second)
+	if age >= e.ttl {
+		return nil
+	}
+	var m dnsmessage.Message
+	if m.Unpack(e.msg) != nil {
+		return nil
+	}
+	m.ID = id
+	for _, sec := range [][]dnsmessage.Resource{m.Answers, m.Authorities, m.Additionals} {
+		for i := range sec {
+			if sec[i].Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if sec[i].Header.TTL > age {
+				sec[i].Header.TTL -= age
+			} else {
+				sec[i].Header.TTL = 0
+			}
+		}
+	}
+	msg, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// truncate resp to size by dropping all records but EDNS(0) and setting TC
+func truncate(resp []byte, size int) []byte {
+	if len(resp) <= size {
+		return resp
+	}
+	var m dnsmessage.Message
+	if m.Unpack(resp) != nil {
+		return nil
+	}
+	m.Truncated = true
+	m.Answers, m.Authorities = nil, nil
+	additionals := m.Additionals[:0]
+	for _, r := range m.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			additionals = append(additionals, r)
+		}
+	}
+	m.Additionals = additionals
+	msg, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+// exchangeall tries the plain DNS and DoT servers then the DoH servers,
+// of which the json ones can only answer A, AAAA and CNAME
+func (ds *DNSList) exchangeall(ctx context.Context, q []byte) ([]byte, error) {
+	resp, err := ds.exchange(ctx, q)
+	if err == nil {
+		return resp, nil
+	}
+	ctx = withbootstrap(ctx, ds)
+	s := ds.load()
+	cfg := s.health.withdefaults()
+	for _, r := range s.ranked() {
+		if !r.addr.ishttps() {
+			continue
+		}
+		start := time.Now()
+		resp, err = r.exchangedoh(ctx, q, s)
+		if err == nil {
+			r.addr.succeeded(&cfg, time.Since(start))
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if !errors.Is(err, ErrUnsupportedQuery) {
+			r.addr.failed(&cfg, err)
+		}
+	}
+	return nil, err
+}
+
+// exchangedoh q with this DoH server and check the answer
+func (r *racer) exchangedoh(ctx context.Context, q []byte, s *serverset) ([]byte, error) {
+	if r.addr.up.Format == DoHFormatWire {
+		return s.secure(ctx, q, func(ctx context.Context, q []byte) ([]byte, error) {
+			resp, err := exchangedoh(ctx, r.addr.up, q)
+			if err != nil {
+				return nil, err
+			}
+			err = s.poison.checkmsg(resp)
+			if err != nil {
+				return nil, err
+			}
+			return resp, nil
+		})
+	}
+	qi, err := parsequery(q)
+	if err != nil {
+		return nil, err
+	}
+	typ := qi.question.Type
+	if qi.question.Class != dnsmessage.ClassINET ||
+		(typ != dnsmessage.TypeA && typ != dnsmessage.TypeAAAA && typ != dnsmessage.TypeCNAME) {
+		return nil, ErrUnsupportedQuery
+	}
+	jr, err := lookupdohwithtype(ctx, r.addr.up, normname(qi.question.Name.String()), recordType(typ))
+	if err != nil && jr.Status == 0 { // not an rcode
+		return nil, err
+	}
+	err = s.poison.check(jr.hosts())
+	if err != nil {
+		return nil, err
+	}
+	answers, err := jr.resources()
+	if err != nil {
+		return nil, err
+	}
+	resp := qi.reply(dnsmessage.RCode(jr.Status), answers)
+	if resp == nil {
+		return nil, ErrInvalidResponse
+	}
+	return resp, nil
+}
+
+// resources converts the A, AAAA and CNAME answers of jr to wire records
+func (jr *dohjsonresponse) resources() ([]dnsmessage.Resource, error) {
+	answers := make([]dnsmessage.Resource, 0, len(jr.Answer))
+	for _, ans := range jr.Answer {
+		name := ans.Name
+		if !strings.HasSuffix(name, ".") {
+			name += "."
+		}
+		n, err := dnsmessage.NewName(name)
+		if err != nil {
+			return nil, err
+		}
+		h := dnsmessage.ResourceHeader{Name: n, Type: dnsmessage.Type(ans.Type), Class: dnsmessage.ClassINET, TTL: ans.TTL}
+		switch ans.Type {
+		case recordTypeA:
+			ip := net.ParseIP(ans.Data).To4()
+			if ip == nil {
+				return nil, ErrInvalidResponse
+			}
+			r := &dnsmessage.AResource{}
+			copy(r.A[:], ip)
+			answers = append(answers, dnsmessage.Resource{Header: h, Body: r})
+		case recordTypeAAAA:
+			ip := net.ParseIP(ans.Data)
+			if ip == nil {
+				return nil, ErrInvalidResponse
+			}
+			r := &dnsmessage.AAAAResource{}
+			copy(r.AAAA[:], ip)
+			answers = append(answers, dnsmessage.Resource{Header: h, Body: r})
+		case recordType(dnsmessage.TypeCNAME):
+			target := ans.Data
+			if !strings.HasSuffix(target, ".") {
+				target += "."
+			}
+			t, err := dnsmessage.NewName(target)
+			if err != nil {
+				return nil, err
+			}
+			answers = append(answers, dnsmessage.Resource{Header: h, Body: &dnsmessage.CNAMEResource{CNAME: t}})
+		}
+	}
+	return answers, nil
+}
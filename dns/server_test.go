@@ -0,0 +1,158 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startserver serves a fake upstream through srv and returns the
+// addr of srv and the counter of queries reaching the upstream
+func startserver(t *testing.T, srv *Server) (string, *atomic.Int32) {
+	n := &atomic.Int32{}
+	txt := []string{strings.Repeat("a", 250), strings.Repeat("b", 250), strings.Repeat("c", 250)}
+	upstream := startfakedns(t, func(q dnsmessage.Question, b *dnsmessage.Builder) error {
+		n.Add(1)
+		if q.Type == dnsmessage.TypeTXT {
+			return b.TXTResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.TXTResource{TXT: txt})
+		}
+		return fakeanswer("192.0.2.1", "")(q, b)
+	})
+	local := &DNSList{}
+	local.Add(&DNSConfig{Servers: map[string][]string{"local": {"udp://" + upstream}}})
+	srv.Router = &Router{}
+	srv.Router.SetGroup("local", local)
+	srv.Router.SetDefault("local")
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(pc, ln) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return pc.LocalAddr().String(), n
+}
+
+// rawquery without EDNS(0)
+func rawquery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func askudp(t *testing.T, addr string, q []byte) dnsmessage.Message {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err = m.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func asktcp(t *testing.T, addr string, q []byte) dnsmessage.Message {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write(append([]byte{byte(len(q) >> 8), byte(len(q))}, q...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := readstreammsg(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m dnsmessage.Message
+	if err = m.Unpack(msg); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestServer(t *testing.T) {
+	ov := &Overrides{}
+	_ = ov.Set("pin.terasu.test", "192.0.2.9")
+	_ = ov.Alias("alias.terasu.test", "aliased.terasu.test")
+	srv := &Server{Overrides: ov}
+	addr, n := startserver(t, srv)
+
+	q, err := newquery(1, "server.terasu.test", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		m := askudp(t, addr, q)
+		if m.ID != 1 || len(m.Answers) != 1 || m.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+			t.Fatal("unexpected", m)
+		}
+	}
+	if n.Load() != 1 {
+		t.Fatal("expected a cached answer but upstream got", n.Load())
+	}
+
+	// purged along with HostCache
+	HostCache.Delete("Server.terasu.test.")
+	if m := askudp(t, addr, q); len(m.Answers) != 1 || n.Load() != 2 {
+		t.Fatal("unexpected", m, n.Load())
+	}
+
+	m := asktcp(t, addr, rawquery(t, "pin.terasu.test.", dnsmessage.TypeA))
+	if len(m.Answers) != 1 || m.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 9} {
+		t.Fatal("unexpected", m)
+	}
+	// the alias is resolved by the router of the server
+	m = asktcp(t, addr, rawquery(t, "alias.terasu.test.", dnsmessage.TypeA))
+	if len(m.Answers) != 2 || m.Answers[1].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+		t.Fatal("unexpected", m)
+	}
+
+	// never leaked to the built-in servers
+	_ = srv.Router.Route("missing.terasu.test", "missing")
+	m = askudp(t, addr, rawquery(t, "www.missing.terasu.test.", dnsmessage.TypeA))
+	if m.RCode != dnsmessage.RCodeRefused || len(m.Answers) != 0 {
+		t.Fatal("unexpected", m)
+	}
+
+	q = rawquery(t, "txt.terasu.test.", dnsmessage.TypeTXT)
+	m = askudp(t, addr, q)
+	if !m.Truncated || len(m.Answers) != 0 {
+		t.Fatal("expected truncation", m.Header)
+	}
+	m = asktcp(t, addr, q)
+	if m.Truncated || len(m.Answers) != 1 || len(m.Answers[0].Body.(*dnsmessage.TXTResource).TXT) != 3 {
+		t.Fatal("unexpected", m)
+	}
+	q, err = newquery(2, "txt.terasu.test", dnsmessage.TypeTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fits in the EDNS(0) payload size
+	if m = askudp(t, addr, q); m.Truncated || len(m.Answers) != 1 {
+		t.Fatal("unexpected", m.Header)
+	}
+}
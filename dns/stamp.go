@@ -0,0 +1,266 @@
+package dns
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+const stampScheme = "sdns://"
+
+const (
+	StampDoH = 0x02 // StampDoH is the protocol of DNS over HTTPS stamps
+	StampDoT = 0x03 // StampDoT is the protocol of DNS over TLS stamps
+)
+
+// informal properties of a stamp
+const (
+	StampDNSSEC   uint64 = 1 << iota // StampDNSSEC means the server validates DNSSEC
+	StampNoLog                       // StampNoLog means the server keeps no logs
+	StampNoFilter                    // StampNoFilter means the server does not block names
+)
+
+var (
+	// ErrInvalidStamp is reported on malformed or unsupported sdns:// stamps
+	ErrInvalidStamp = errors.New("invalid dns stamp")
+)
+
+// Stamp is a DoH or DoT server stamp of https://dnscrypt.info/stamps-specifications
+type Stamp struct {
+	Proto uint8
+	Props uint64
+	// Addr is the ip[:port] to connect, may be empty to resolve Host
+	Addr string
+	// Hashes are the SHA256 of the TBS certificates, any of them in the chain matches
+	Hashes [][]byte
+	// Host is the hostname[:port] of the server
+	Host string
+	// Path is the DoH path
+	Path string
+	// Bootstrap are the IPs to resolve Host
+	Bootstrap []string
+}
+
+type stampreader struct {
+	b   []byte
+	err error
+}
+
+// lp reads a length-prefixed string
+func (r *stampreader) lp() string {
+	if r.err != nil {
+		return ""
+	}
+	if len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		r.err = ErrInvalidStamp
+		return ""
+	}
+	s := string(r.b[1 : 1+r.b[0]])
+	r.b = r.b[1+r.b[0]:]
+	return s
+}
+
+// vlp reads a set of length-prefixed strings whose high bit tells more
+func (r *stampreader) vlp() (lst []string) {
+	for r.err == nil {
+		if len(r.b) < 1 {
+			r.err = ErrInvalidStamp
+			return
+		}
+		more := r.b[0]&0x80 != 0
+		n := int(r.b[0] &^ 0x80)
+		if len(r.b) < 1+n {
+			r.err = ErrInvalidStamp
+			return
+		}
+		if n > 0 {
+			lst = append(lst, string(r.b[1:1+n]))
+		}
+		r.b = r.b[1+n:]
+		if !more {
+			return
+		}
+	}
+	return
+}
+
+// ParseStamp parses a DoH or DoT sdns:// stamp
+func ParseStamp(s string) (*Stamp, error) {
+	if !strings.HasPrefix(s, stampScheme) {
+		return nil, ErrInvalidStamp
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s[len(stampScheme):], "="))
+	if err != nil || len(b) < 9 {
+		return nil, ErrInvalidStamp
+	}
+	st := &Stamp{Proto: b[0], Props: binary.LittleEndian.Uint64(b[1:])}
+	if st.Proto != StampDoH && st.Proto != StampDoT {
+		return nil, ErrInvalidStamp
+	}
+	r := stampreader{b: b[9:]}
+	st.Addr = r.lp()
+	for _, h := range r.vlp() {
+		if len(h) != 32 {
+			return nil, ErrInvalidStamp
+		}
+		st.Hashes = append(st.Hashes, []byte(h))
+	}
+	st.Host = r.lp()
+	if st.Proto == StampDoH {
+		st.Path = r.lp()
+	}
+	if r.err == nil && len(r.b) > 0 {
+		for _, ip := range r.vlp() {
+			st.Bootstrap = append(st.Bootstrap, strings.Trim(ip, "[]"))
+		}
+	}
+	if r.err != nil || st.Host == "" {
+		return nil, ErrInvalidStamp
+	}
+	return st, nil
+}
+
+func appendlp(b []byte, s string) []byte {
+	return append(append(b, byte(len(s))), s...)
+}
+
+func appendvlp(b []byte, lst []string) []byte {
+	if len(lst) == 0 {
+		return append(b, 0)
+	}
+	for i, s := range lst {
+		n := byte(len(s))
+		if i < len(lst)-1 {
+			n |= 0x80
+		}
+		b = append(append(b, n), s...)
+	}
+	return b
+}
+
+// String encodes st as an sdns:// stamp
+func (st *Stamp) String() string {
+	b := []byte{st.Proto}
+	b = binary.LittleEndian.AppendUint64(b, st.Props)
+	b = appendlp(b, st.Addr)
+	hashes := make([]string, 0, len(st.Hashes))
+	for _, h := range st.Hashes {
+		hashes = append(hashes, string(h))
+	}
+	b = appendvlp(b, hashes)
+	b = appendlp(b, st.Host)
+	if st.Proto == StampDoH {
+		b = appendlp(b, st.Path)
+	}
+	if len(st.Bootstrap) > 0 {
+		b = appendvlp(b, st.Bootstrap)
+	}
+	return stampScheme + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Upstream converts st into its hostname and upstream addresses,
+// a DoT stamp without Addr connects to each of its bootstrap IPs,
+// or to its Host on port 853 if it has none
+func (st *Stamp) Upstream() (string, []*Upstream, error) {
+	hostname, hostport, err := net.SplitHostPort(st.Host)
+	if err != nil {
+		hostname = strings.Trim(st.Host, "[]")
+	}
+	ip, port := "", hostport
+	if st.Addr != "" {
+		ip = st.Addr
+		if h, p, err := net.SplitHostPort(st.Addr); err == nil {
+			ip, port = h, p
+		}
+		ip = strings.Trim(ip, "[]")
+		if net.ParseIP(ip) == nil {
+			return "", nil, ErrInvalidStamp
+		}
+	}
+	for _, b := range st.Bootstrap {
+		if net.ParseIP(b) == nil {
+			return "", nil, ErrInvalidStamp
+		}
+	}
+	var certhashes []string
+	for _, h := range st.Hashes {
+		certhashes = append(certhashes, hex.EncodeToString(h))
+	}
+	var addrs []string
+	switch st.Proto {
+	case StampDoH:
+		u := url.URL{Scheme: SchemeHTTPS, Host: hostname, Path: st.Path}
+		if port != "" && port != "443" {
+			u.Host = net.JoinHostPort(hostname, port)
+		}
+		q := url.Values{"format": {DoHFormatWire}}
+		bootstrap := st.Bootstrap
+		if ip != "" {
+			bootstrap = append([]string{ip}, bootstrap...)
+		}
+		if len(bootstrap) > 0 {
+			q.Set("bootstrap", strings.Join(bootstrap, ","))
+		}
+		if len(certhashes) > 0 {
+			q["certhash"] = certhashes
+		}
+		u.RawQuery = q.Encode()
+		addrs = append(addrs, u.String())
+	case StampDoT:
+		if port == "" {
+			port = "853"
+		}
+		hosts := st.Bootstrap
+		if ip != "" {
+			hosts = []string{ip}
+		}
+		if len(hosts) == 0 {
+			if hostname == "" {
+				return "", nil, ErrInvalidStamp
+			}
+			hosts = []string{hostname}
+		}
+		// the hostname is the key and thus the sni
+		opts := ""
+		if len(certhashes) > 0 {
+			opts = "?" + url.Values{"certhash": certhashes}.Encode()
+		}
+		for _, h := range hosts {
+			addrs = append(addrs, SchemeTLS+"://"+net.JoinHostPort(h, port)+opts)
+		}
+	}
+	ups := make([]*Upstream, 0, len(addrs))
+	for _, a := range addrs {
+		up, err := ParseUpstream(a)
+		if err != nil {
+			return "", nil, err
+		}
+		ups = append(ups, up)
+	}
+	return hostname, ups, nil
+}
+
+// AddStamp adds the servers of an sdns:// stamp to c
+func (c *DNSConfig) AddStamp(s string) error {
+	st, err := ParseStamp(s)
+	if err != nil {
+		return err
+	}
+	host, ups, err := st.Upstream()
+	if err != nil {
+		return err
+	}
+	if c.Servers == nil {
+		c.Servers = map[string][]string{}
+	}
+	for _, up := range ups {
+		if a := up.String(); !hasfallback(c.Servers[host], a) {
+			c.Servers[host] = append(c.Servers[host], a)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStamp(t *testing.T) {
+	const cloudflare = "sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5"
+	st, err := ParseStamp(cloudflare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Proto != StampDoH || st.Props != StampDNSSEC|StampNoLog|StampNoFilter || st.Addr != "1.0.0.1" ||
+		st.Host != "dns.cloudflare.com" || st.Path != "/dns-query" || len(st.Hashes) != 0 {
+		t.Fatalf("unexpected %+v", st)
+	}
+	if st.String() != cloudflare {
+		t.Fatal("unstable stamp", st.String())
+	}
+	host, ups, err := st.Upstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "dns.cloudflare.com" || len(ups) != 1 ||
+		ups[0].String() != "https://dns.cloudflare.com/dns-query?bootstrap=1.0.0.1&format=wire" {
+		t.Fatal("unexpected", host, ups)
+	}
+
+	h := sha256.Sum256([]byte("tbs"))
+	dot := &Stamp{
+		Proto: StampDoT, Props: StampDNSSEC, Hashes: [][]byte{h[:]},
+		Host: "dot.terasu.test", Bootstrap: []string{"192.0.2.53", "2001:db8::53"},
+	}
+	st, err = ParseStamp(dot.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.String() != dot.String() || len(st.Hashes) != 1 || !bytes.Equal(st.Hashes[0], h[:]) || len(st.Bootstrap) != 2 {
+		t.Fatalf("unexpected %+v", st)
+	}
+	c := &DNSConfig{}
+	if err = c.AddStamp(dot.String()); err != nil {
+		t.Fatal(err)
+	}
+	addrs := c.Servers["dot.terasu.test"]
+	if len(addrs) != 2 || addrs[1] != "tls://[2001:db8::53]:853?certhash="+hex.EncodeToString(h[:]) {
+		t.Fatal("unexpected", addrs)
+	}
+	up, err := ParseUpstream(addrs[0])
+	if err != nil || up.Host != "192.0.2.53:853" || len(up.CertHashes) != 1 || !bytes.Equal(up.CertHashes[0], h[:]) {
+		t.Fatal("unexpected", up, err)
+	}
+
+	for _, s := range []string{
+		"https://1.1.1.1", "sdns://AA", "sdns://AQcAAAAAAAAABzEuMC4wLjE",
+		(&Stamp{Proto: StampDoT, Host: "dot.terasu.test"}).String()[:20],
+	} {
+		if _, err = ParseStamp(s); err == nil {
+			t.Fatal("expected error on", s)
+		}
+	}
+	// resolved by its own hostname on the default port
+	host, ups, err = (&Stamp{Proto: StampDoT, Host: "dot.terasu.test"}).Upstream()
+	if err != nil || host != "dot.terasu.test" || len(ups) != 1 || ups[0].Host != "dot.terasu.test:853" {
+		t.Fatal("unexpected", host, ups, err)
+	}
+	if _, _, err = (&Stamp{Proto: StampDoT}).Upstream(); err != ErrInvalidStamp {
+		t.Fatal("unexpected", err)
+	}
+
+	c, err = ParseDNSConfig([]byte("Stamps:\n  - "+cloudflare+"\n"), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Stamps) != 0 || len(c.Servers["dns.cloudflare.com"]) != 1 {
+		t.Fatal("unexpected", c)
+	}
+}
+
+func TestUpstreamCertHash(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	h := sha256.Sum256(cert.RawTBSCertificate)
+	_, ups, err := (&Stamp{Proto: StampDoT, Addr: "192.0.2.1", Host: "dot.terasu.test", Hashes: [][]byte{h[:]}}).Upstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ups[0].tlsconfig(&tls.Config{}).VerifyConnection(cs); err != nil {
+		t.Fatal(err)
+	}
+	h[0]++
+	_, ups, err = (&Stamp{Proto: StampDoT, Addr: "192.0.2.1", Host: "dot.terasu.test", Hashes: [][]byte{h[:]}}).Upstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ups[0].tlsconfig(&tls.Config{}).VerifyConnection(cs); err != ErrCertHashMismatch {
+		t.Fatal("unexpected", err)
+	}
+}
+
+func TestDoHCertHashNoRetry(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trusted and valid for the name, only the hash is wrong
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), DNSNames: []string{"doh.terasu.test"},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				_ = tls.Server(conn, &tls.Config{
+					Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+				}).Handshake()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+	up, err := ParseUpstream("https://doh.terasu.test:" + port + "/dns-query?bootstrap=127.0.0.1&certhash=" + strings.Repeat("00", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	_, err = dialdoh(ctx, "tcp", "doh.terasu.test:"+port, &tls.Config{ServerName: "doh.terasu.test", RootCAs: roots}, up)
+	if !errors.Is(err, ErrCertHashMismatch) || accepted.Load() != 1 {
+		t.Fatal("unexpected", err, accepted.Load())
+	}
+}
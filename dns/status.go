@@ -0,0 +1,40 @@
+package dns
+
+import "time"
+
+// ServerStatus is the state of one server at the time of Snapshot
+type ServerStatus struct {
+	Host         string        `json:"host"` // Host is the TLS server name
+	Addr         string        `json:"addr"`
+	DoH          bool          `json:"doh"`
+	Enabled      bool          `json:"enabled"`
+	Latency      time.Duration `json:"latency"` // Latency is the EWMA of successful queries
+	Success      uint64        `json:"success"`
+	Failure      uint64        `json:"failure"`
+	BackoffUntil time.Time     `json:"backoff_until"`
+	Score        time.Duration `json:"score"` // Score is the expected cost, lower is better
+}
+
+// Snapshot returns the status of all servers in configuration order
+func (ds *DNSList) Snapshot() []ServerStatus {
+	s := ds.load()
+	c := s.health.withdefaults()
+	sts := make([]ServerStatus, 0, 16)
+	_ = s.rangeHosts(func(host string, addrs []*dnsstat) error {
+		for _, addr := range addrs {
+			sts = append(sts, ServerStatus{
+				Host:         host,
+				Addr:         addr.addr,
+				DoH:          addr.ishttps(),
+				Enabled:      addr.enabled(),
+				Latency:      time.Duration(addr.latency.Load()),
+				Success:      addr.succ.Load(),
+				Failure:      addr.fail.Load(),
+				BackoffUntil: addr.backoffuntil(),
+				Score:        addr.score(&c),
+			})
+		}
+		return nil
+	})
+	return sts
+}
@@ -0,0 +1,318 @@
+package dns
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	SchemeTLS   = "tls"   // SchemeTLS is DNS over TLS (RFC 7858)
+	SchemeHTTPS = "https" // SchemeHTTPS is DNS over HTTPS (RFC 8484 or JSON API)
+	SchemeUDP   = "udp"   // SchemeUDP is plain DNS, for trusted local networks only
+	SchemeTCP   = "tcp"   // SchemeTCP is plain DNS over TCP, for trusted local networks only
+	// SchemeIterative resolves by ourselves from the root servers over tcp
+	SchemeIterative = "iterative"
+)
+
+const (
+	DoHFormatJSON = "json" // DoHFormatJSON is the application/dns-json API
+	DoHFormatWire = "wire" // DoHFormatWire is the application/dns-message of RFC 8484
+)
+
+var (
+	// ErrInvalidUpstream is reported on malformed upstream addresses
+	ErrInvalidUpstream = errors.New("invalid upstream")
+	// ErrPinMismatch is reported when no cert of the server matches the pins
+	ErrPinMismatch = errors.New("spki pin mismatch")
+	// ErrCertHashMismatch is reported when no cert of the server matches the cert hashes
+	ErrCertHashMismatch = errors.New("cert hash mismatch")
+)
+
+// Upstream is a parsed server address such as
+//
+//	tls://1.1.1.1:853?sni=cloudflare-dns.com&fragment=5&padding=0
+//	https://dns.google/dns-query?format=wire&pin=base64(sha256(spki))
+//	https://doh.sb/dns-query?bootstrap=185.222.222.222,45.11.45.11
+//	tls://9.9.9.9?certhash=hex(sha256(tbs certificate))
+//	udp://192.168.1.1?ecs=auto
+//	iterative://root?hints=198.41.0.4,199.9.14.201
+//
+// An address without scheme, like 1.1.1.1:853, is treated as tls.
+type Upstream struct {
+	Scheme string
+	// Host is host:port for tls, udp and tcp, host[:port] of the https URL
+	// or just a name for iterative
+	Host string
+	// URL is the DoH endpoint without the options below
+	URL string
+	// Format is the DoH format, DoHFormatJSON by default
+	Format string
+	// SNI overrides the TLS server name, which is the
+	// key of DNSConfig.Servers for tls or the URL host for https
+	SNI string
+	// Fragment is the first fragment len of the TLS handshake,
+	// -1 means the default of the caller and 0 disables fragmentation
+	Fragment int
+	// Pins are the SHA256 of accepted SubjectPublicKeyInfo, any of them matches
+	Pins [][]byte
+	// CertHashes are the SHA256 of accepted TBS certificates as in DNS stamps,
+	// any of them matches
+	CertHashes [][]byte
+	// Bootstrap are the fixed IPs of the https URL host
+	Bootstrap []string
+	// Padding is the block length queries are padded to (RFC 7830),
+	// -1 means DefaultPaddingBlock for DoT and wire DoH and 0 disables it
+	Padding int
+	// ECS is the client subnet sent to this server, nil sends none
+	ECS *ECS
+	// Hints are the root server IPs of iterative, RootHints if empty
+	Hints []string
+}
+
+// ParseUpstream parses s into an Upstream
+func ParseUpstream(s string) (*Upstream, error) {
+	if !strings.Contains(s, "://") {
+		s = SchemeTLS + "://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, ErrInvalidUpstream
+	}
+	if !isascii(u.Host) {
+		hostname, err := ToASCII(u.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		port := u.Port()
+		u.Host = hostname
+		if port != "" {
+			u.Host = net.JoinHostPort(hostname, port)
+		}
+	}
+	up := &Upstream{Scheme: strings.ToLower(u.Scheme), Host: u.Host, Fragment: -1, Padding: -1}
+	q := u.Query()
+	if v := q.Get("sni"); v != "" {
+		up.SNI, err = ToASCII(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if v := q.Get("fragment"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return nil, ErrInvalidUpstream
+		}
+		up.Fragment = int(n)
+	}
+	for _, v := range q["pin"] {
+		// an unescaped + in the query is decoded as space
+		pin, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(v, " ", "+"))
+		if err != nil || len(pin) != 32 {
+			return nil, ErrInvalidUpstream
+		}
+		up.Pins = append(up.Pins, pin)
+	}
+	for _, v := range q["certhash"] {
+		h, err := hex.DecodeString(v)
+		if err != nil || len(h) != 32 {
+			return nil, ErrInvalidUpstream
+		}
+		up.CertHashes = append(up.CertHashes, h)
+	}
+	for _, v := range q["bootstrap"] {
+		for _, a := range strings.Split(v, ",") {
+			ip := net.ParseIP(strings.TrimSpace(a))
+			if ip == nil {
+				return nil, ErrInvalidUpstream
+			}
+			up.Bootstrap = append(up.Bootstrap, ip.String())
+		}
+	}
+	for _, v := range q["hints"] {
+		for _, a := range strings.Split(v, ",") {
+			ip := net.ParseIP(strings.TrimSpace(a))
+			if ip == nil {
+				return nil, ErrInvalidUpstream
+			}
+			up.Hints = append(up.Hints, ip.String())
+		}
+	}
+	if v := q.Get("padding"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			return nil, ErrInvalidUpstream
+		}
+		up.Padding = int(n)
+	}
+	if v := q.Get("ecs"); v != "" {
+		up.ECS, err = ParseECS(v)
+		if err != nil {
+			return nil, ErrInvalidUpstream
+		}
+	}
+	switch up.Scheme {
+	case SchemeTLS:
+		up.Host = withport(up.Host, "853")
+	case SchemeUDP, SchemeTCP:
+		up.Host = withport(up.Host, "53")
+	case SchemeIterative:
+	case SchemeHTTPS:
+		up.Format = DoHFormatJSON
+		if v := q.Get("format"); v != "" {
+			if v != DoHFormatJSON && v != DoHFormatWire {
+				return nil, ErrInvalidUpstream
+			}
+			up.Format = v
+		}
+		for _, k := range []string{"sni", "fragment", "pin", "certhash", "format", "bootstrap", "padding", "ecs", "hints"} {
+			q.Del(k)
+		}
+		u.RawQuery = q.Encode()
+		up.URL = u.String()
+	default:
+		return nil, ErrInvalidUpstream
+	}
+	return up, nil
+}
+
+func withport(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// String is the canonical form of up
+func (up *Upstream) String() string {
+	sb := strings.Builder{}
+	if up.Scheme == SchemeHTTPS {
+		sb.WriteString(up.URL)
+	} else {
+		sb.WriteString(up.Scheme)
+		sb.WriteString("://")
+		sb.WriteString(up.Host)
+	}
+	q := url.Values{}
+	if up.Scheme == SchemeHTTPS && up.Format != DoHFormatJSON {
+		q.Set("format", up.Format)
+	}
+	if up.SNI != "" {
+		q.Set("sni", up.SNI)
+	}
+	if up.Fragment >= 0 {
+		q.Set("fragment", strconv.Itoa(up.Fragment))
+	}
+	for _, pin := range up.Pins {
+		q.Add("pin", base64.StdEncoding.EncodeToString(pin))
+	}
+	for _, h := range up.CertHashes {
+		q.Add("certhash", hex.EncodeToString(h))
+	}
+	if len(up.Bootstrap) > 0 {
+		q.Set("bootstrap", strings.Join(up.Bootstrap, ","))
+	}
+	if up.Padding >= 0 {
+		q.Set("padding", strconv.Itoa(up.Padding))
+	}
+	if up.ECS != nil {
+		q.Set("ecs", up.ECS.String())
+	}
+	if len(up.Hints) > 0 {
+		q.Set("hints", strings.Join(up.Hints, ","))
+	}
+	if len(q) > 0 {
+		if strings.Contains(up.URL, "?") {
+			sb.WriteByte('&')
+		} else {
+			sb.WriteByte('?')
+		}
+		sb.WriteString(q.Encode())
+	}
+	return sb.String()
+}
+
+// hastlsoptions tells whether up needs its own TLS settings
+func (up *Upstream) hastlsoptions() bool {
+	return up.SNI != "" || up.Fragment >= 0 || len(up.Pins) > 0 || len(up.CertHashes) > 0
+}
+
+// tlsconfig applies the SNI, pins and cert hashes of up to a clone of cfg
+func (up *Upstream) tlsconfig(cfg *tls.Config) *tls.Config {
+	if up.SNI == "" && len(up.Pins) == 0 && len(up.CertHashes) == 0 {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	if up.SNI != "" {
+		cfg.ServerName = up.SNI
+	}
+	if len(up.Pins) > 0 || len(up.CertHashes) > 0 {
+		cfg.VerifyConnection = up.verifyconn
+	}
+	return cfg
+}
+
+// verifyconn checks both the pins and the cert hashes if any
+func (up *Upstream) verifyconn(cs tls.ConnectionState) error {
+	if len(up.Pins) > 0 {
+		if err := up.verifypins(cs); err != nil {
+			return err
+		}
+	}
+	if len(up.CertHashes) > 0 {
+		return up.verifycerthashes(cs)
+	}
+	return nil
+}
+
+// verifypins accepts the chain if any cert matches any pin,
+// it runs after the normal verification of the chain.
+func (up *Upstream) verifypins(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range up.Pins {
+			if bytes.Equal(h[:], pin) {
+				return nil
+			}
+		}
+	}
+	return ErrPinMismatch
+}
+
+// verifycerthashes accepts the chain if any cert matches any hash
+func (up *Upstream) verifycerthashes(cs tls.ConnectionState) error {
+	for _, cert := range cs.PeerCertificates {
+		h := sha256.Sum256(cert.RawTBSCertificate)
+		for _, ch := range up.CertHashes {
+			if bytes.Equal(h[:], ch) {
+				return nil
+			}
+		}
+	}
+	return ErrCertHashMismatch
+}
+
+// SPKIPin is the pin of cert to be used in the pin option of upstreams
+func SPKIPin(cert *x509.Certificate) string {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// fragment is the first fragment len with def as the default
+func (up *Upstream) fragment(def uint8) uint8 {
+	if up.Fragment >= 0 {
+		return uint8(up.Fragment)
+	}
+	return def
+}
@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseUpstream(t *testing.T) {
+	for _, c := range []struct {
+		in, scheme, host, url, sni, format string
+		fragment, pins                     int
+	}{
+		{"1.1.1.1:853", SchemeTLS, "1.1.1.1:853", "", "", "", -1, 0},
+		{"169.254.122.111", SchemeTLS, "169.254.122.111:853", "", "", "", -1, 0},
+		{"[2a09::]:853", SchemeTLS, "[2a09::]:853", "", "", "", -1, 0},
+		{"tls://8.8.8.8?sni=dns.google&fragment=5", SchemeTLS, "8.8.8.8:853", "", "dns.google", "", 5, 0},
+		{"udp://192.168.1.1", SchemeUDP, "192.168.1.1:53", "", "", "", -1, 0},
+		{"tcp://[::1]:5353", SchemeTCP, "[::1]:5353", "", "", "", -1, 0},
+		{"https://dns.google/resolve", SchemeHTTPS, "dns.google", "https://dns.google/resolve", "", DoHFormatJSON, -1, 0},
+		{
+			"https://1.1.1.1/dns-query?format=wire&sni=cloudflare-dns.com&fragment=0&pin=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+			SchemeHTTPS, "1.1.1.1", "https://1.1.1.1/dns-query", "cloudflare-dns.com", DoHFormatWire, 0, 1,
+		},
+	} {
+		up, err := ParseUpstream(c.in)
+		if err != nil {
+			t.Fatal(c.in, err)
+		}
+		if up.Scheme != c.scheme || up.Host != c.host || up.URL != c.url || up.SNI != c.sni ||
+			up.Format != c.format || up.Fragment != c.fragment || len(up.Pins) != c.pins {
+			t.Fatalf("%s: unexpected %+v", c.in, up)
+		}
+		up2, err := ParseUpstream(up.String())
+		if err != nil {
+			t.Fatal(up.String(), err)
+		}
+		if up2.String() != up.String() {
+			t.Fatal("unstable string", up.String(), up2.String())
+		}
+	}
+	for _, in := range []string{"quic://1.1.1.1", "tls://1.1.1.1?fragment=256", "https://1.1.1.1/?pin=abc", "https:///path"} {
+		if _, err := ParseUpstream(in); err == nil {
+			t.Fatal("expected error on", in)
+		}
+	}
+}
+
+// startfakedns serves queries on udp and returns its addr,
+// answer builds the response of each question.
+func startfakedns(t *testing.T, answer func(q dnsmessage.Question, b *dnsmessage.Builder) error) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			resp, err := fakeresponse(buf[:n], answer)
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// fakeresponse answers the query msg by answer
+func fakeresponse(msg []byte, answer func(q dnsmessage.Question, b *dnsmessage.Builder) error) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID: h.ID, Response: true, RecursionDesired: h.RecursionDesired, RecursionAvailable: true,
+	})
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+	err = answer(q, &b)
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+func fakeanswer(a, aaaa string) func(q dnsmessage.Question, b *dnsmessage.Builder) error {
+	return func(q dnsmessage.Question, b *dnsmessage.Builder) error {
+		h := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		switch {
+		case q.Type == dnsmessage.TypeA && a != "":
+			var r dnsmessage.AResource
+			copy(r.A[:], net.ParseIP(a).To4())
+			return b.AResource(h, r)
+		case q.Type == dnsmessage.TypeAAAA && aaaa != "":
+			var r dnsmessage.AAAAResource
+			copy(r.AAAA[:], net.ParseIP(aaaa))
+			return b.AAAAResource(h, r)
+		}
+		return nil
+	}
+}
+
+func TestUDPUpstream(t *testing.T) {
+	addr := startfakedns(t, fakeanswer("192.0.2.1", ""))
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"local": {"udp://" + addr}}})
+	ds.SetRace(1, 0)
+	addrs, err := ds.lookupHostRace(context.Background(), "upstream.terasu.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != "192.0.2.1" {
+		t.Fatal("unexpected", addrs)
+	}
+	if st := ds.Snapshot(); st[0].Success != 1 {
+		t.Fatal("unexpected status", st)
+	}
+}
+
+func TestUpstreamPins(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+
+	up, err := ParseUpstream("tls://192.0.2.1?sni=resolver.test&pin=" + url.QueryEscape(SPKIPin(cert)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := up.tlsconfig(&tls.Config{ServerName: "orig.test"})
+	if cfg.ServerName != "resolver.test" || cfg.VerifyConnection == nil {
+		t.Fatal("options not applied")
+	}
+	if err = cfg.VerifyConnection(cs); err != nil {
+		t.Fatal(err)
+	}
+	up, err = ParseUpstream("tls://192.0.2.1?pin=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = up.tlsconfig(&tls.Config{}).VerifyConnection(cs); err != ErrPinMismatch {
+		t.Fatal("unexpected", err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	up, err := ParseUpstream("https://doh.terasu.test/dns-query?bootstrap=192.0.2.9,2001:db8::9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := bootstrap(context.Background(), "doh.terasu.test", up)
+	if err != nil || len(addrs) != 2 || addrs[0] != "192.0.2.9" {
+		t.Fatal("unexpected", addrs, err)
+	}
+
+	addr := startfakedns(t, fakeanswer("192.0.2.10", ""))
+	ds := DNSList{}
+	ds.Add(&DNSConfig{Servers: map[string][]string{"local": {"udp://" + addr}}})
+	ds.SetStrictBootstrap(true)
+	ctx := withbootstrap(context.Background(), &ds)
+	addrs, err = bootstrap(ctx, "doh2.terasu.test", nil)
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.10" {
+		t.Fatal("unexpected", addrs, err)
+	}
+	if HostCache.Get("doh2.terasu.test") != nil {
+		t.Fatal("bootstrap leaked into lookup table")
+	}
+
+	empty := DNSList{}
+	empty.SetStrictBootstrap(true)
+	_, err = bootstrap(withbootstrap(context.Background(), &empty), "doh3.terasu.test", nil)
+	if !errors.Is(err, ErrStrictBootstrap) {
+		t.Fatal("unexpected", err)
+	}
+
+	// what a loose list found never serves a strict one
+	loose := DNSList{}
+	loose.Add(&DNSConfig{Servers: map[string][]string{"local": {"udp://" + addr}}})
+	addrs, err = bootstrap(withbootstrap(context.Background(), &loose), "doh4.terasu.test", nil)
+	if err != nil || len(addrs) != 1 || addrs[0] != "192.0.2.10" {
+		t.Fatal("unexpected", addrs, err)
+	}
+	_, err = bootstrap(withbootstrap(context.Background(), &empty), "doh4.terasu.test", nil)
+	if !errors.Is(err, ErrStrictBootstrap) {
+		t.Fatal("unexpected", err)
+	}
+	up, _ = ParseUpstream("https://doh4.terasu.test/dns-query")
+	if c := dohclient(withbootstrap(context.Background(), &loose), up); c == dohclient(withbootstrap(context.Background(), &empty), up) ||
+		c == &trsHTTP2ClientWithSystemDNS {
+		t.Fatal("doh client shared across lists")
+	}
+}
@@ -0,0 +1,238 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ednsPayloadLen is the EDNS(0) UDP payload size recommended by DNS flag day 2020
+const ednsPayloadLen = 1232
+
+var (
+	// ErrInvalidResponse is reported on malformed or mismatched responses
+	ErrInvalidResponse = errors.New("invalid response")
+)
+
+// newquery packs a recursive query of name in typ with EDNS(0)
+func newquery(id uint16, name string, typ dnsmessage.Type) ([]byte, error) {
+	if !isascii(name) {
+		a, err := ToASCII(name)
+		if err != nil {
+			return nil, err
+		}
+		name = a
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID: id, RecursionDesired: true,
+	})
+	b.EnableCompression()
+	err = b.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	err = b.Question(dnsmessage.Question{Name: n, Type: typ, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	err = b.StartAdditionals()
+	if err != nil {
+		return nil, err
+	}
+	var rh dnsmessage.ResourceHeader
+	err = rh.SetEDNS0(ednsPayloadLen, dnsmessage.RCodeSuccess, false)
+	if err != nil {
+		return nil, err
+	}
+	err = b.OPTResource(rh, dnsmessage.OPTResource{})
+	if err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// optof returns the EDNS(0) record of m, adding an empty one if none
+func optof(m *dnsmessage.Message) (*dnsmessage.OPTResource, error) {
+	for _, r := range m.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT {
+			return r.Body.(*dnsmessage.OPTResource), nil
+		}
+	}
+	var h dnsmessage.ResourceHeader
+	err := h.SetEDNS0(ednsPayloadLen, dnsmessage.RCodeSuccess, false)
+	if err != nil {
+		return nil, err
+	}
+	opt := &dnsmessage.OPTResource{}
+	m.Additionals = append(m.Additionals, dnsmessage.Resource{Header: h, Body: opt})
+	return opt, nil
+}
+
+// readstreammsg reads one message prefixed by its 2 bytes length (RFC 1035 4.2.2)
+func readstreammsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	_, err := io.ReadFull(r, l[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// exchangepacket sends q on a connected udp conn and waits for the response of the same id
+func exchangepacket(ctx context.Context, conn net.Conn, q []byte) ([]byte, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dnsDialer.Timeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	_, err := conn.Write(q)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// ignore stray packets
+		if n >= 12 && buf[0] == q[0] && buf[1] == q[1] {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+// questionname is the first question name of msg without the trailing dot
+func questionname(msg []byte) string {
+	var p dnsmessage.Parser
+	_, err := p.Start(msg)
+	if err != nil {
+		return ""
+	}
+	q, err := p.Question()
+	if err != nil {
+		return ""
+	}
+	return normname(q.Name.String())
+}
+
+// truncated tells whether the TC bit of msg is set
+func truncated(msg []byte) bool {
+	return len(msg) >= 12 && msg[2]&0x02 != 0
+}
+
+// parseresponse converts a wire response into the json shape
+func parseresponse(msg []byte) (jr dohjsonresponse, err error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return
+	}
+	if !h.Response {
+		err = ErrInvalidResponse
+		return
+	}
+	jr.Status = uint32(h.RCode)
+	jr.TC = h.Truncated
+	jr.RD = h.RecursionDesired
+	jr.RA = h.RecursionAvailable
+	jr.AD = h.AuthenticData
+	jr.CD = h.CheckingDisabled
+	qs, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+	for _, q := range qs {
+		jr.Question = append(jr.Question, dohjsonquestion{
+			Name: q.Name.String(), Type: recordType(q.Type),
+		})
+	}
+	for {
+		var rh dnsmessage.ResourceHeader
+		rh, err = p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		ans := dohjsonanswer{Name: rh.Name.String(), Type: recordType(rh.Type), TTL: rh.TTL}
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			var r dnsmessage.AResource
+			r, err = p.AResource()
+			ans.Data = net.IP(r.A[:]).String()
+		case dnsmessage.TypeAAAA:
+			var r dnsmessage.AAAAResource
+			r, err = p.AAAAResource()
+			ans.Data = net.IP(r.AAAA[:]).String()
+		case dnsmessage.TypeCNAME:
+			var r dnsmessage.CNAMEResource
+			r, err = p.CNAMEResource()
+			ans.Data = r.CNAME.String()
+		case dnsmessage.TypeNS:
+			var r dnsmessage.NSResource
+			r, err = p.NSResource()
+			ans.Data = r.NS.String()
+		case dnsmessage.TypePTR:
+			var r dnsmessage.PTRResource
+			r, err = p.PTRResource()
+			ans.Data = r.PTR.String()
+		case dnsmessage.TypeMX:
+			var r dnsmessage.MXResource
+			r, err = p.MXResource()
+			ans.Data = strconv.Itoa(int(r.Pref)) + " " + r.MX.String()
+		case dnsmessage.TypeTXT:
+			var r dnsmessage.TXTResource
+			r, err = p.TXTResource()
+			quoted := make([]string, len(r.TXT))
+			for i, t := range r.TXT {
+				quoted[i] = strconv.Quote(t)
+			}
+			ans.Data = strings.Join(quoted, " ")
+		case dnsmessage.TypeSRV:
+			var r dnsmessage.SRVResource
+			r, err = p.SRVResource()
+			ans.Data = fmt.Sprintf("%d %d %d %s", r.Priority, r.Weight, r.Port, r.Target)
+		case dnsmessage.TypeSOA:
+			var r dnsmessage.SOAResource
+			r, err = p.SOAResource()
+			ans.Data = fmt.Sprintf("%s %s %d %d %d %d %d", r.NS, r.MBox, r.Serial, r.Refresh, r.Retry, r.Expire, r.MinTTL)
+		default: // no presentation format, skip it
+			err = p.SkipAnswer()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			return
+		}
+		jr.Answer = append(jr.Answer, ans)
+	}
+	if jr.Status != 0 {
+		err = errors.New("rcode: " + dnsmessage.RCode(jr.Status).String())
+	}
+	return
+}
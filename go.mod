@@ -3,12 +3,10 @@ module github.com/fumiama/terasu
 go 1.20
 
 require (
-	github.com/FloatTech/ttl v0.0.0-20250224045156-012b1463287d
 	github.com/sirupsen/logrus v1.9.3
 	golang.org/x/net v0.24.0
+	golang.org/x/sys v0.19.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	golang.org/x/sys v0.19.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
-)
+require golang.org/x/text v0.14.0 // indirect
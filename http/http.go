@@ -12,6 +12,7 @@ import (
 
 	"github.com/fumiama/terasu"
 	"github.com/fumiama/terasu/dns"
+	"github.com/fumiama/terasu/ip"
 )
 
 var (
@@ -35,6 +36,11 @@ var DefaultClient = http.Client{
 			if err != nil {
 				return nil, err
 			}
+			// the SNI and certificates carry A-labels
+			host, err = dns.ToASCII(host)
+			if err != nil {
+				return nil, err
+			}
 			addrs, err := dns.LookupHost(ctx, host)
 			if err != nil {
 				return nil, err
@@ -107,6 +113,13 @@ var DefaultClient = http.Client{
 	},
 }
 
+func init() {
+	// connections of the lost or the less preferred stack are stale
+	ip.Subscribe(func(bool) {
+		DefaultClient.Transport.(*http.Transport).CloseIdleConnections()
+	})
+}
+
 func Get(url string) (resp *http.Response, err error) {
 	return DefaultClient.Get(url)
 }
@@ -14,6 +14,7 @@ import (
 
 	"github.com/fumiama/terasu"
 	"github.com/fumiama/terasu/dns"
+	"github.com/fumiama/terasu/ip"
 )
 
 var (
@@ -35,6 +36,21 @@ var DefaultClient = http.Client{
 			if err != nil {
 				return nil, err
 			}
+			// the SNI and certificates carry A-labels
+			host, err = dns.ToASCII(host)
+			if err != nil {
+				return nil, err
+			}
+			if cfg.ServerName != "" {
+				sni, err := dns.ToASCII(cfg.ServerName)
+				if err != nil {
+					return nil, err
+				}
+				if sni != cfg.ServerName {
+					cfg = cfg.Clone()
+					cfg.ServerName = sni
+				}
+			}
 			addrs, err := dns.LookupHost(ctx, host)
 			if err != nil {
 				return nil, err
@@ -96,6 +112,13 @@ var DefaultClient = http.Client{
 	},
 }
 
+func init() {
+	// connections of the lost or the less preferred stack are stale
+	ip.Subscribe(func(bool) {
+		DefaultClient.Transport.(*http2.Transport).CloseIdleConnections()
+	})
+}
+
 func Get(url string) (resp *http.Response, err error) {
 	return DefaultClient.Get(url)
 }
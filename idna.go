@@ -0,0 +1,91 @@
+package terasu
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// maxLabelLen is the longest label in octets (RFC 1035 2.3.4)
+const maxLabelLen = 63
+
+var (
+	// ErrInvalidHostname is matched by errors.Is on any *IDNAError
+	ErrInvalidHostname = errors.New("invalid hostname")
+
+	errLabelTooLong = errors.New("label too long")
+)
+
+// IDNAError reports the label of Name rejected by the UTS #46 lookup profile
+type IDNAError struct {
+	Name  string
+	Label string
+	Err   error
+}
+
+func (e *IDNAError) Error() string {
+	return "invalid label " + strconv.Quote(e.Label) + " of " + strconv.Quote(e.Name) + ": " + e.Err.Error()
+}
+
+func (e *IDNAError) Unwrap() error {
+	return e.Err
+}
+
+func (e *IDNAError) Is(target error) bool {
+	return target == ErrInvalidHostname
+}
+
+// idnadots are the full stops that UTS #46 maps to "."
+var idnadots = strings.NewReplacer("。", ".", "．", ".", "｡", ".")
+
+func isascii(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// hasace tells whether label is already punycode
+func hasace(label string) bool {
+	return len(label) >= 4 && strings.EqualFold(label[:4], "xn--")
+}
+
+// asciiname converts the labels of name into lowercase A-labels without
+// the trailing dot. Plain ASCII labels and wildcards are only lowercased.
+func asciiname(name string) (string, error) {
+	if isascii(name) && !strings.Contains(strings.ToLower(name), "xn--") {
+		return strings.ToLower(strings.TrimSuffix(name, ".")), nil
+	}
+	orig := name
+	name = strings.TrimSuffix(idnadots.Replace(name), ".")
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		if (isascii(l) && !hasace(l)) || strings.ContainsAny(l, "*?[") {
+			labels[i] = strings.ToLower(l)
+			continue
+		}
+		a, err := idna.Lookup.ToASCII(l)
+		if err == nil && len(a) > maxLabelLen {
+			err = errLabelTooLong
+		}
+		if err != nil {
+			return "", &IDNAError{Name: orig, Label: l, Err: err}
+		}
+		labels[i] = a
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToASCII normalises host by the UTS #46 lookup profile into lowercase
+// A-labels without the trailing dot, an IP literal is returned as is
+func ToASCII(host string) (string, error) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return host, nil
+	}
+	return asciiname(host)
+}
@@ -1,3 +1,179 @@
 package ip
 
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IsIPv6Available is the availability detected at start.
+//
+// Deprecated: it does not follow later changes, read IPv6Available
+// instead. Writing a value other than the detected one still forces
+// IPv6Available to it, but subscribers are not told, so migrate such
+// writes to SetIPv6Available.
 var IsIPv6Available = true
+
+// PollInterval is the re-evaluation interval where
+// interface changes cannot be watched
+var PollInterval = time.Second * 30
+
+var (
+	available atomic.Bool
+	started   bool // started is IsIPv6Available as detected at start
+	watchonce sync.Once
+)
+
+var (
+	mu         sync.Mutex
+	subs       = map[int]func(available bool){}
+	nextid     int
+	pending    []bool // pending are the changes not delivered yet, in order
+	delivering bool
+	forced     *bool // forced is set by SetIPv6Available
+)
+
+func init() {
+	started = detect()
+	IsIPv6Available = started
+	available.Store(started)
+}
+
+// IPv6Available tells whether this host has global IPv6 connectivity.
+// It is detected at start and kept updated by Refresh, or on interface
+// changes after Watch is called, unless set by SetIPv6Available.
+func IPv6Available() bool {
+	if IsIPv6Available != started { // forced by a legacy write
+		return IsIPv6Available
+	}
+	return available.Load()
+}
+
+// SetIPv6Available forces the availability, e.g. false to stay on IPv4,
+// and notifies subscribers on change. Refresh and Watch keep it until
+// ResetIPv6Available is called.
+func SetIPv6Available(v bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	forced = &v
+	change(v)
+}
+
+// ResetIPv6Available drops the value of SetIPv6Available and detects again
+func ResetIPv6Available() bool {
+	mu.Lock()
+	forced = nil
+	mu.Unlock()
+	return Refresh()
+}
+
+// Watch starts following the interface changes in the background,
+// by netlink on linux or by polling every PollInterval elsewhere.
+// Calling it more than once has no effect.
+func Watch() {
+	watchonce.Do(func() {
+		go watch()
+	})
+}
+
+// Subscribe calls fn with the new availability whenever it changes,
+// until cancel is called. All subscribers are called one by one from
+// a single goroutine in the order of the changes.
+func Subscribe(fn func(available bool)) (cancel func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	id := nextid
+	nextid++
+	subs[id] = fn
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(subs, id)
+	}
+}
+
+// Refresh re-evaluates the availability now and notifies subscribers on change,
+// a value set by SetIPv6Available is kept and returned
+func Refresh() bool {
+	now := detect()
+	mu.Lock()
+	defer mu.Unlock()
+	if forced != nil {
+		return *forced
+	}
+	change(now)
+	return now
+}
+
+// change the availability to now and queue it for the subscribers,
+// no lock, use under lock
+func change(now bool) {
+	if available.Swap(now) != now {
+		pending = append(pending, now)
+		if !delivering {
+			delivering = true
+			go deliver()
+		}
+	}
+}
+
+// deliver the pending changes to the subscribers until none is left
+func deliver() {
+	for {
+		mu.Lock()
+		if len(pending) == 0 {
+			delivering = false
+			mu.Unlock()
+			return
+		}
+		now := pending[0]
+		pending = pending[1:]
+		fns := make([]func(bool), 0, len(subs))
+		for _, fn := range subs {
+			fns = append(fns, fn)
+		}
+		mu.Unlock()
+		for _, fn := range fns {
+			fn(now)
+		}
+	}
+}
+
+// poll refreshes every PollInterval forever
+func poll() {
+	for {
+		time.Sleep(PollInterval)
+		Refresh()
+	}
+}
+
+// isglobal tells whether ip is a global unicast IPv6 address
+// excluding unique local ones (fc00::/7)
+func isglobal(ip net.IP) bool {
+	return ip.To4() == nil && ip.To16() != nil &&
+		ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+// hasglobaladdr checks the addresses of all up interfaces
+func hasglobaladdr() bool {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && isglobal(ipn.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
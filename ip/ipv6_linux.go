@@ -0,0 +1,144 @@
+//go:build linux
+
+package ip
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ifaFlagDADFailed  = 0x08 // IFA_F_DADFAILED
+	ifaFlagDeprecated = 0x20 // IFA_F_DEPRECATED
+	ifaFlagTentative  = 0x40 // IFA_F_TENTATIVE
+	rtfUp             = 0x0001
+	rtfReject         = 0x0200
+)
+
+// detect a usable global address and a default route in /proc/net
+func detect() bool {
+	addr, err := procglobaladdr("/proc/net/if_inet6")
+	if err != nil {
+		return hasglobaladdr()
+	}
+	if !addr {
+		return false
+	}
+	route, err := procdefaultroute("/proc/net/ipv6_route")
+	if err != nil {
+		return true
+	}
+	return route
+}
+
+// procglobaladdr parses lines of if_inet6 like
+//
+//	20010db8000000000000000000000001 02 40 00 80 eth0
+//
+// that is address, ifindex, prefix len, scope, flags and name
+func procglobaladdr(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 6 || fields[5] == "lo" {
+			continue
+		}
+		b, err := hex.DecodeString(fields[0])
+		if err != nil || len(b) != net.IPv6len {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[4], 16, 32)
+		if err != nil || flags&(ifaFlagDADFailed|ifaFlagDeprecated|ifaFlagTentative) != 0 {
+			continue
+		}
+		if isglobal(net.IP(b)) {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// procdefaultroute parses lines of ipv6_route for ::/0 that is up and not
+// a reject route, the fields are dst, dst len, src, src len, next hop,
+// metric, refcnt, use, flags and name
+func procdefaultroute(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 || fields[9] == "lo" {
+			continue
+		}
+		if strings.Trim(fields[0], "0") != "" || fields[1] != "00" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[8], 16, 32)
+		if err != nil {
+			continue
+		}
+		if flags&rtfUp != 0 && flags&rtfReject == 0 {
+			return true, nil
+		}
+	}
+	return false, sc.Err()
+}
+
+// watch refreshes on netlink notifications of IPv6 addresses, routes
+// and links, or polls if netlink is unavailable
+func watch() {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		poll()
+		return
+	}
+	defer unix.Close(fd)
+	err = unix.Bind(fd, &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV6_IFADDR | unix.RTMGRP_IPV6_ROUTE,
+	})
+	if err != nil {
+		poll()
+		return
+	}
+	changed := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			_, _, err := unix.Recvfrom(fd, buf, 0)
+			if err != nil && err != unix.EINTR && err != unix.ENOBUFS {
+				close(changed)
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	for range changed {
+		// wait for a burst of changes such as DAD to settle
+		time.Sleep(time.Second)
+		select {
+		case <-changed:
+		default:
+		}
+		Refresh()
+	}
+	poll()
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package ip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcParse(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	p := write("if_inet6_local", `00000000000000000000000000000001 01 80 10 80       lo
+fe800000000000000000000000000001 02 40 20 80     eth0
+fd000000000000000000000000000001 02 40 00 80     eth0
+20010db8000000000000000000000001 02 40 00 40     eth0
+`)
+	if ok, err := procglobaladdr(p); err != nil || ok {
+		t.Fatal("unexpected", ok, err)
+	}
+	p = write("if_inet6_global", "20010db8000000000000000000000001 02 40 00 80     eth0\n")
+	if ok, err := procglobaladdr(p); err != nil || !ok {
+		t.Fatal("unexpected", ok, err)
+	}
+
+	p = write("ipv6_route_reject", `00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo
+fe800000000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0
+`)
+	if ok, err := procdefaultroute(p); err != nil || ok {
+		t.Fatal("unexpected", ok, err)
+	}
+	p = write("ipv6_route_default", "00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00450003     eth0\n")
+	if ok, err := procdefaultroute(p); err != nil || !ok {
+		t.Fatal("unexpected", ok, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	ch := make(chan bool, 4)
+	cancel := Subscribe(func(available bool) { ch <- available })
+	defer cancel()
+	old := available.Load()
+	defer available.Store(old)
+	// the changes arrive in order
+	var want []bool
+	for i := 0; i < 3; i++ {
+		available.Store(!detect())
+		want = append(want, Refresh())
+	}
+	for _, w := range want {
+		if got := <-ch; got != w {
+			t.Fatal("unexpected", got)
+		}
+	}
+	if IPv6Available() != detect() {
+		t.Fatal("unexpected", IPv6Available())
+	}
+}
+
+func TestSetIPv6Available(t *testing.T) {
+	defer ResetIPv6Available()
+	ch := make(chan bool, 2)
+	cancel := Subscribe(func(available bool) { ch <- available })
+	defer cancel()
+	v := !IPv6Available()
+	SetIPv6Available(v)
+	if Refresh() != v || IPv6Available() != v {
+		t.Fatal("forced value not kept")
+	}
+	if got := <-ch; got != v {
+		t.Fatal("unexpected", got)
+	}
+	if ResetIPv6Available() != detect() || IPv6Available() != detect() {
+		t.Fatal("unexpected", IPv6Available())
+	}
+
+	// the deprecated variable is still honoured
+	defer func() { IsIPv6Available = started }()
+	IsIPv6Available = !started
+	if IPv6Available() != !started {
+		t.Fatal("legacy write ignored")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ip
+
+// detect a usable global address on any interface
+func detect() bool {
+	return hasglobaladdr()
+}
+
+// watch polls as interface changes cannot be watched portably
+func watch() {
+	poll()
+}
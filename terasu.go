@@ -15,6 +15,9 @@ func Use(conn *tls.Conn) *Conn {
 
 // Handshake do terasu handshake in this TLS conn
 func (conn *Conn) Handshake(firstFragmentLen uint8) error {
+	if err := conn.asciisni(); err != nil {
+		return err
+	}
 	expose := (*_trsconn)(unsafe.Pointer(conn))
 	fnbak := expose.handshakeFn
 	expose.handshakeFn = conn.clientHandshake(firstFragmentLen)
@@ -24,9 +27,29 @@ func (conn *Conn) Handshake(firstFragmentLen uint8) error {
 
 // Handshake do terasu handshake with ctx in this TLS conn
 func (conn *Conn) HandshakeContext(ctx context.Context, firstFragmentLen uint8) error {
+	if err := conn.asciisni(); err != nil {
+		return err
+	}
 	expose := (*_trsconn)(unsafe.Pointer(conn))
 	fnbak := expose.handshakeFn
 	expose.handshakeFn = conn.clientHandshake(firstFragmentLen)
 	defer func() { expose.handshakeFn = fnbak }()
 	return (*tls.Conn)(conn).HandshakeContext(ctx)
 }
+
+// asciisni sends the A-labels of an internationalized server name,
+// on a clone of the config as it may be shared by other conns
+func (conn *Conn) asciisni() error {
+	expose := (*_trsconn)(unsafe.Pointer(conn))
+	if expose.config == nil || isascii(expose.config.ServerName) {
+		return nil
+	}
+	name, err := ToASCII(expose.config.ServerName)
+	if err != nil {
+		return err
+	}
+	cfg := expose.config.Clone()
+	cfg.ServerName = name
+	expose.config = cfg
+	return nil
+}
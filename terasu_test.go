@@ -2,6 +2,7 @@ package terasu
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"net/http"
@@ -84,3 +85,33 @@ func TestHTTPDialTLS12(t *testing.T) {
 	}
 	t.Log(string(data))
 }
+
+func TestHandshakeSNI(t *testing.T) {
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+	sni := make(chan string, 1)
+	go func() {
+		_ = tls.Server(srv, &tls.Config{
+			GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+				sni <- chi.ServerName
+				return nil, errors.New("stop")
+			},
+		}).Handshake()
+		_ = srv.Close()
+	}()
+	cfg := &tls.Config{ServerName: "Bücher.Example", InsecureSkipVerify: true}
+	_ = Use(tls.Client(cli, cfg)).Handshake(DefaultFirstFragmentLen)
+	if got := <-sni; got != "xn--bcher-kva.example" {
+		t.Fatal("unexpected server_name", got)
+	}
+	if cfg.ServerName != "Bücher.Example" {
+		t.Fatal("caller config modified", cfg.ServerName)
+	}
+
+	c := tls.Client(cli, &tls.Config{ServerName: "a\u200db.example"})
+	var ierr *IDNAError
+	if err := Use(c).Handshake(DefaultFirstFragmentLen); !errors.Is(err, ErrInvalidHostname) || !errors.As(err, &ierr) {
+		t.Fatal("unexpected", err)
+	}
+}